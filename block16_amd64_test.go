@@ -10,6 +10,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"math/rand"
 	"strings"
 	"testing"
 	"unsafe"
@@ -189,6 +190,66 @@ func TestBlock16Masked(t *testing.T) {
 	}
 }
 
+// TestBlockDifferential compares the assembly with the portable code,
+// using the same mask rounds and lanes of different lengths.
+func TestBlockDifferential(t *testing.T) {
+	if !hasAVX2 {
+		t.SkipNow()
+	}
+	rng := rand.New(rand.NewSource(0))
+	base := make([]byte, 32+16*internalBlockSize)
+	for iter := 0; iter < 100; iter++ {
+		var input [16][]byte
+		var init digest16
+		for i := range input {
+			init.v0[i], init.v1[i], init.v2[i], init.v3[i] = rng.Uint32(), rng.Uint32(), rng.Uint32(), rng.Uint32()
+			if rng.Intn(5) == 0 {
+				continue
+			}
+			s := 32 + i*internalBlockSize
+			input[i] = base[s : s+BlockSize*(1+rng.Intn(internalBlockSize/BlockSize))]
+			rng.Read(input[i])
+		}
+
+		want := init
+		var mr16 [16]maskRounds
+		blockGeneric16(&want, input, &mr16)
+		for i := range input {
+			dig := [4]uint32{init.v0[i], init.v1[i], init.v2[i], init.v3[i]}
+			blockScalar(&dig, input[i])
+			if dig != [4]uint32{want.v0[i], want.v1[i], want.v2[i], want.v3[i]} {
+				t.Fatalf("iteration %d, lane %d: scalar assembly mismatch", iter, i)
+			}
+		}
+
+		if hasAVX512 {
+			got := init
+			blockMd5_avx512(&got, input, &mr16)
+			if got != want {
+				t.Fatalf("iteration %d: avx512 got %x, want %x", iter, got, want)
+			}
+		}
+
+		var mr8 [8]maskRounds
+		for h := 0; h < 2; h++ {
+			var d8 digest8
+			var i8 [8][]byte
+			for i := range d8.v0 {
+				j := i + 8*h
+				d8.v0[i], d8.v1[i], d8.v2[i], d8.v3[i] = init.v0[j], init.v1[j], init.v2[j], init.v3[j]
+				i8[i] = input[j]
+			}
+			blockMd5_avx2(&d8, i8, &mr8)
+			for i := range d8.v0 {
+				j := i + 8*h
+				if [4]uint32{d8.v0[i], d8.v1[i], d8.v2[i], d8.v3[i]} != [4]uint32{want.v0[j], want.v1[j], want.v2[j], want.v3[j]} {
+					t.Fatalf("iteration %d, lane %d: avx2 mismatch", iter, j)
+				}
+			}
+		}
+	}
+}
+
 func BenchmarkBlock8(b *testing.B) {
 	if !cpuid.CPU.Supports(cpuid.AVX2) {
 		b.SkipNow()
@@ -1,4 +1,5 @@
-//+build !noasm,!appengine,gc
+//go:build !noasm && !appengine && gc
+// +build !noasm,!appengine,gc
 
 // Copyright (c) 2020 MinIO Inc. All rights reserved.
 // Use of this source code is governed by a license that can be
@@ -14,11 +15,25 @@ import (
 	"github.com/klauspost/cpuid/v2"
 )
 
-var hasAVX512 bool
+var hasAVX512, hasAVX2 bool
 
 func init() {
 	// VANDNPD requires AVX512DQ. Technically it could be VPTERNLOGQ which is AVX512F.
 	hasAVX512 = cpuid.CPU.Supports(cpuid.AVX512F, cpuid.AVX512DQ)
+	hasAVX2 = cpuid.CPU.Supports(cpuid.AVX2)
+}
+
+// AvailableBackends returns the backends that can be used on the current CPU.
+// BackendAuto is not included.
+func AvailableBackends() []Backend {
+	var b []Backend
+	if hasAVX512 {
+		b = append(b, BackendAVX512)
+	}
+	if hasAVX2 {
+		b = append(b, BackendAVX2)
+	}
+	return append(b, BackendScalarAsm, BackendStdlib, BackendGeneric)
 }
 
 //go:noescape
@@ -27,38 +42,11 @@ func block8(state *uint32, base uintptr, bufs *int32, cache *byte, n int)
 //go:noescape
 func block16(state *uint32, base uintptr, ptrs *int32, mask uint64, n int)
 
-// 8-way 4x uint32 digests in 4 ymm registers
-// (ymm0, ymm1, ymm2, ymm3)
-type digest8 struct {
-	v0, v1, v2, v3 [8]uint32
-}
-
 // Stack cache for 8x64 byte md5.BlockSize bytes.
 // Must be 32-byte aligned, so allocate 512+32 and
 // align upwards at runtime.
 type cache8 [512 + 32]byte
 
-// MD5 magic numbers for one lane of hashing; inflated
-// 8x below at init time.
-var md5consts = [64]uint32{
-	0xd76aa478, 0xe8c7b756, 0x242070db, 0xc1bdceee,
-	0xf57c0faf, 0x4787c62a, 0xa8304613, 0xfd469501,
-	0x698098d8, 0x8b44f7af, 0xffff5bb1, 0x895cd7be,
-	0x6b901122, 0xfd987193, 0xa679438e, 0x49b40821,
-	0xf61e2562, 0xc040b340, 0x265e5a51, 0xe9b6c7aa,
-	0xd62f105d, 0x02441453, 0xd8a1e681, 0xe7d3fbc8,
-	0x21e1cde6, 0xc33707d6, 0xf4d50d87, 0x455a14ed,
-	0xa9e3e905, 0xfcefa3f8, 0x676f02d9, 0x8d2a4c8a,
-	0xfffa3942, 0x8771f681, 0x6d9d6122, 0xfde5380c,
-	0xa4beea44, 0x4bdecfa9, 0xf6bb4b60, 0xbebfbc70,
-	0x289b7ec6, 0xeaa127fa, 0xd4ef3085, 0x04881d05,
-	0xd9d4d039, 0xe6db99e5, 0x1fa27cf8, 0xc4ac5665,
-	0xf4292244, 0x432aff97, 0xab9423a7, 0xfc93a039,
-	0x655b59c3, 0x8f0ccc92, 0xffeff47d, 0x85845dd1,
-	0x6fa87e4f, 0xfe2ce6e0, 0xa3014314, 0x4e0811a1,
-	0xf7537e82, 0xbd3af235, 0x2ad7d2bb, 0xeb86d391,
-}
-
 // inflate the consts 8-way for 8x md5 (256 bit ymm registers)
 var avx256md5consts = func(c []uint32) []uint32 {
 	inf := make([]uint32, 8*len(c))
@@ -70,11 +58,6 @@ var avx256md5consts = func(c []uint32) []uint32 {
 	return inf
 }(md5consts[:])
 
-// 16-way 4x uint32 digests in 4 zmm registers
-type digest16 struct {
-	v0, v1, v2, v3 [16]uint32
-}
-
 // inflate the consts 16-way for 16x md5 (512 bit zmm registers)
 var avx512md5consts = func(c []uint32) []uint32 {
 	inf := make([]uint32, 16*len(c))
@@ -86,10 +69,38 @@ var avx512md5consts = func(c []uint32) []uint32 {
 	return inf
 }(md5consts[:])
 
+// laneBase returns the address the assembly addresses the lanes of input from.
+// Lanes are addressed with 32 bit offsets, so false is returned
+// if the lanes are too far apart.
+func laneBase(input [][]byte) (base uintptr, ok bool) {
+	var lo, hi uintptr
+	for _, in := range input {
+		if len(in) == 0 {
+			continue
+		}
+		start := uintptr(unsafe.Pointer(&in[0]))
+		if lo == 0 || start < lo {
+			lo = start
+		}
+		if end := start + uintptr(len(in)); end > hi {
+			hi = end
+		}
+	}
+	// Leave 32 bytes in front, so no lane has offset 0.
+	base = lo - 32
+	return base, hi-base <= math.MaxInt32
+}
+
 // Interface function to assembly code
-func (s *md5Server) blockMd5_x16(d *digest16, input [16][]byte, half bool, useAVX512 bool) {
-	if hasAVX512 && useAVX512 {
-		blockMd5_avx512(d, input, s.allBufs, &s.maskRounds16)
+func (s *md5Server) blockMd5_x16(d *digest16, input [16][]byte, half bool) {
+	switch s.backend {
+	case BackendAVX512:
+		rounds := blockMd5_avx512(d, input, &s.maskRounds16)
+		s.stats.addRound(roundAVX512, s.maskRounds16[:rounds], 16)
+		return
+	case BackendGeneric:
+		rounds := blockGeneric16(d, input, &s.maskRounds16)
+		s.stats.addRound(roundGeneric, s.maskRounds16[:rounds], 16)
 		return
 	}
 
@@ -103,7 +114,8 @@ func (s *md5Server) blockMd5_x16(d *digest16, input [16][]byte, half bool, useAV
 		for i := range s.d8a.v0[:] {
 			s.d8a.v0[i], s.d8a.v1[i], s.d8a.v2[i], s.d8a.v3[i] = d.v0[i], d.v1[i], d.v2[i], d.v3[i]
 		}
-		blockMd5_avx2(&s.d8a, s.i8[0], s.allBufs, &s.maskRounds8a)
+		rounds := blockMd5_avx2(&s.d8a, s.i8[0], &s.maskRounds8a)
+		s.stats.addRound(roundAVX2Half, s.maskRounds8a[:rounds], 8)
 		for i := range s.d8a.v0[:] {
 			d.v0[i], d.v1[i], d.v2[i], d.v3[i] = s.d8a.v0[i], s.d8a.v1[i], s.d8a.v2[i], s.d8a.v3[i]
 		}
@@ -122,10 +134,28 @@ func (s *md5Server) blockMd5_x16(d *digest16, input [16][]byte, half bool, useAV
 
 	// Benchmarks appears to be slightly faster when spinning up 2 goroutines instead
 	// of using the current for one of the blocks.
+	// Panics are passed back to this goroutine, so safeBlocks can recover from them.
+	var roundsA, roundsB int
 	s.wg.Add(2)
-	go func() { blockMd5_avx2(&s.d8a, s.i8[0], s.allBufs, &s.maskRounds8a); s.wg.Done() }()
-	go func() { blockMd5_avx2(&s.d8b, s.i8[1], s.allBufs, &s.maskRounds8b); s.wg.Done() }()
+	go func() {
+		defer s.wg.Done()
+		defer func() { s.panics[0] = recover() }()
+		roundsA = blockMd5_avx2(&s.d8a, s.i8[0], &s.maskRounds8a)
+	}()
+	go func() {
+		defer s.wg.Done()
+		defer func() { s.panics[1] = recover() }()
+		roundsB = blockMd5_avx2(&s.d8b, s.i8[1], &s.maskRounds8b)
+	}()
 	s.wg.Wait()
+	for i := range s.panics[:2] {
+		if r := s.panics[i]; r != nil {
+			s.panics[0], s.panics[1] = nil, nil
+			panic(r)
+		}
+	}
+	s.stats.addRound(roundAVX2Full, s.maskRounds8a[:roundsA], 8)
+	s.stats.addBlocks(s.maskRounds8b[:roundsB], 8)
 	for i := range s.d8a.v0[:] {
 		d.v0[i], d.v1[i], d.v2[i], d.v3[i] = s.d8a.v0[i], s.d8a.v1[i], s.d8a.v2[i], s.d8a.v3[i]
 	}
@@ -136,28 +166,29 @@ func (s *md5Server) blockMd5_x16(d *digest16, input [16][]byte, half bool, useAV
 }
 
 // Interface function to AVX512 assembly code
-func blockMd5_avx512(s *digest16, input [16][]byte, base []byte, maskRounds *[16]maskRounds) {
-	baseMin := uint64(uintptr(unsafe.Pointer(&(base[0]))))
+// Lanes are addressed with 32 bit offsets from their laneBase.
+// The number of mask rounds used is returned.
+func blockMd5_avx512(s *digest16, input [16][]byte, maskRounds *[16]maskRounds) (rounds int) {
+	sdup := *s // create copy of initial states to receive intermediate updates
+
+	rounds = generateMaskAndRounds16(input, maskRounds)
+
+	// Take the base after the last call, since growing the stack moves lanes
+	// that live on it, but not the base.
+	base, _ := laneBase(input[:])
+	baseMin := uint64(base)
 	ptrs := [16]int32{}
 
 	for i := range ptrs {
 		if len(input[i]) > 0 {
-			if len(input[i]) > internalBlockSize {
-				panic(fmt.Sprintf("Sanity check fails for lane %d: maximum input length cannot exceed internalBlockSize", i))
-			}
-
 			off := uint64(uintptr(unsafe.Pointer(&(input[i][0])))) - baseMin
-			if off > math.MaxUint32 {
+			if off+uint64(len(input[i])) > math.MaxInt32 {
 				panic(fmt.Sprintf("invalid buffer sent with offset %x", off))
 			}
 			ptrs[i] = int32(off)
 		}
 	}
 
-	sdup := *s // create copy of initial states to receive intermediate updates
-
-	rounds := generateMaskAndRounds16(input, maskRounds)
-
 	for r := 0; r < rounds; r++ {
 		m := maskRounds[r]
 
@@ -170,33 +201,40 @@ func blockMd5_avx512(s *digest16, input [16][]byte, base []byte, maskRounds *[16
 			}
 		}
 	}
+	return rounds
 }
 
 // Interface function to AVX2 assembly code
-func blockMd5_avx2(s *digest8, input [8][]byte, base []byte, maskRounds *[8]maskRounds) {
-	baseMin := uint64(uintptr(unsafe.Pointer(&(base[0])))) - 4
+// Lanes are addressed with 32 bit offsets from their laneBase.
+// The number of mask rounds used is returned.
+func blockMd5_avx2(s *digest8, input [8][]byte, maskRounds *[8]maskRounds) (rounds int) {
+	sdup := *s // create copy of initial states to receive intermediate updates
+
+	rounds = generateMaskAndRounds8(input, maskRounds)
+
+	// Take the base after the last call, since growing the stack moves lanes
+	// that live on it, but not the base.
+	base, _ := laneBase(input[:])
+	baseMin := uint64(base) - 4
 	ptrs := [8]int32{}
 
 	for i := range ptrs {
 		if len(input[i]) > 0 {
-			if len(input[i]) > internalBlockSize {
-				panic(fmt.Sprintf("Sanity check fails for lane %d: maximum input length cannot exceed internalBlockSize", i))
-			}
-
 			off := uint64(uintptr(unsafe.Pointer(&(input[i][0])))) - baseMin
-			if off > math.MaxUint32 {
+			if off+uint64(len(input[i])) > math.MaxInt32 {
 				panic(fmt.Sprintf("invalid buffer sent with offset %x", off))
 			}
 			ptrs[i] = int32(off)
 		}
 	}
 
-	sdup := *s // create copy of initial states to receive intermediate updates
-
-	rounds := generateMaskAndRounds8(input, maskRounds)
-
 	for r := 0; r < rounds; r++ {
 		m := maskRounds[r]
+		for j := range ptrs {
+			if m.mask&(1<<j) == 0 {
+				ptrs[j] = 0 // offset 0 masks the lane, so finished lanes are not read past their end
+			}
+		}
 		var cache cache8 // stack storage for block8 tmp state
 		block8(&sdup.v0[0], uintptr(baseMin), &ptrs[0], &cache[0], int(64*m.rounds))
 
@@ -207,4 +245,5 @@ func blockMd5_avx2(s *digest8, input [8][]byte, base []byte, maskRounds *[8]mask
 			}
 		}
 	}
+	return rounds
 }
@@ -0,0 +1,27 @@
+//+build !amd64 appengine !gc noasm
+
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+// No assembly is available, so only the portable backends can be used.
+const hasAVX512, hasAVX2 = false, false
+
+// AvailableBackends returns the backends that can be used on the current CPU.
+// BackendAuto is not included.
+func AvailableBackends() []Backend {
+	return []Backend{BackendStdlib, BackendGeneric}
+}
+
+// blockScalar uses the portable implementation when no assembly is available.
+func blockScalar(dig *[4]uint32, p []byte) {
+	blockGeneric(dig, p)
+}
+
+// Interface function to the portable code.
+func (s *md5Server) blockMd5_x16(d *digest16, input [16][]byte, half bool) {
+	rounds := blockGeneric16(d, input, &s.maskRounds16)
+	s.stats.addRound(roundGeneric, s.maskRounds16[:rounds], 16)
+}
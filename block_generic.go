@@ -0,0 +1,140 @@
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// MD5 magic numbers for one lane of hashing; inflated
+// 8x and 16x for the assembly at init time.
+var md5consts = [64]uint32{
+	0xd76aa478, 0xe8c7b756, 0x242070db, 0xc1bdceee,
+	0xf57c0faf, 0x4787c62a, 0xa8304613, 0xfd469501,
+	0x698098d8, 0x8b44f7af, 0xffff5bb1, 0x895cd7be,
+	0x6b901122, 0xfd987193, 0xa679438e, 0x49b40821,
+	0xf61e2562, 0xc040b340, 0x265e5a51, 0xe9b6c7aa,
+	0xd62f105d, 0x02441453, 0xd8a1e681, 0xe7d3fbc8,
+	0x21e1cde6, 0xc33707d6, 0xf4d50d87, 0x455a14ed,
+	0xa9e3e905, 0xfcefa3f8, 0x676f02d9, 0x8d2a4c8a,
+	0xfffa3942, 0x8771f681, 0x6d9d6122, 0xfde5380c,
+	0xa4beea44, 0x4bdecfa9, 0xf6bb4b60, 0xbebfbc70,
+	0x289b7ec6, 0xeaa127fa, 0xd4ef3085, 0x04881d05,
+	0xd9d4d039, 0xe6db99e5, 0x1fa27cf8, 0xc4ac5665,
+	0xf4292244, 0x432aff97, 0xab9423a7, 0xfc93a039,
+	0x655b59c3, 0x8f0ccc92, 0xffeff47d, 0x85845dd1,
+	0x6fa87e4f, 0xfe2ce6e0, 0xa3014314, 0x4e0811a1,
+	0xf7537e82, 0xbd3af235, 0x2ad7d2bb, 0xeb86d391,
+}
+
+// Rotation and message word index for each of the 64 steps.
+var (
+	md5shifts = [64]int{
+		7, 12, 17, 22, 7, 12, 17, 22, 7, 12, 17, 22, 7, 12, 17, 22,
+		5, 9, 14, 20, 5, 9, 14, 20, 5, 9, 14, 20, 5, 9, 14, 20,
+		4, 11, 16, 23, 4, 11, 16, 23, 4, 11, 16, 23, 4, 11, 16, 23,
+		6, 10, 15, 21, 6, 10, 15, 21, 6, 10, 15, 21, 6, 10, 15, 21,
+	}
+	md5words = [64]uint8{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		1, 6, 11, 0, 5, 10, 15, 4, 9, 14, 3, 8, 13, 2, 7, 12,
+		5, 8, 11, 14, 1, 4, 7, 10, 13, 0, 3, 6, 9, 12, 15, 2,
+		0, 7, 14, 5, 12, 3, 10, 1, 8, 15, 6, 13, 4, 11, 2, 9,
+	}
+)
+
+// blockGeneric is the portable equivalent of blockScalar.
+// All complete blocks of p are added to dig.
+func blockGeneric(dig *[4]uint32, p []byte) {
+	a, b, c, d := dig[0], dig[1], dig[2], dig[3]
+	var x [16]uint32
+	for ; len(p) >= BlockSize; p = p[BlockSize:] {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(p[4*i:])
+		}
+		aa, bb, cc, dd := a, b, c, d
+		for i := 0; i < 64; i++ {
+			var f uint32
+			switch i >> 4 {
+			case 0:
+				f = d ^ (b & (c ^ d))
+			case 1:
+				f = c ^ (d & (b ^ c))
+			case 2:
+				f = b ^ c ^ d
+			case 3:
+				f = c ^ (b | ^d)
+			}
+			a, d, c, b = d, c, b, b+bits.RotateLeft32(a+f+md5consts[i]+x[md5words[i]], md5shifts[i])
+		}
+		a += aa
+		b += bb
+		c += cc
+		d += dd
+	}
+	dig[0], dig[1], dig[2], dig[3] = a, b, c, d
+}
+
+// block16Generic is the portable equivalent of block16.
+// n bytes are hashed in all lanes in lock-step, starting at offs in each input,
+// but only lanes enabled in mask are read and updated.
+func block16Generic(s *digest16, input *[16][]byte, offs *[16]int, mask uint64, n int) {
+	var x [16][16]uint32 // x[word][lane]
+	for blk := 0; blk < n; blk += BlockSize {
+		for l := range input {
+			if mask&(1<<uint(l)) == 0 {
+				continue
+			}
+			p := input[l][offs[l]+blk : offs[l]+blk+BlockSize]
+			for w := range x {
+				x[w][l] = binary.LittleEndian.Uint32(p[4*w:])
+			}
+		}
+		a, b, c, d := s.v0, s.v1, s.v2, s.v3
+		for i := 0; i < 64; i++ {
+			k, w, sh := md5consts[i], &x[md5words[i]], md5shifts[i]
+			for l := range a {
+				var f uint32
+				switch i >> 4 {
+				case 0:
+					f = d[l] ^ (b[l] & (c[l] ^ d[l]))
+				case 1:
+					f = c[l] ^ (d[l] & (b[l] ^ c[l]))
+				case 2:
+					f = b[l] ^ c[l] ^ d[l]
+				case 3:
+					f = c[l] ^ (b[l] | ^d[l])
+				}
+				a[l], d[l], c[l], b[l] = d[l], c[l], b[l], b[l]+bits.RotateLeft32(a[l]+f+k+w[l], sh)
+			}
+		}
+		for l := range a {
+			if mask&(1<<uint(l)) != 0 {
+				s.v0[l] += a[l]
+				s.v1[l] += b[l]
+				s.v2[l] += c[l]
+				s.v3[l] += d[l]
+			}
+		}
+	}
+}
+
+// blockGeneric16 is the portable equivalent of blockMd5_avx512.
+// Inputs are processed in the same mask rounds as the assembly,
+// but are read directly, so they need not share a base buffer.
+// The number of mask rounds used is returned.
+func blockGeneric16(s *digest16, input [16][]byte, maskRounds *[16]maskRounds) (rounds int) {
+	var offs [16]int
+	rounds = generateMaskAndRounds16(input, maskRounds)
+	for r := 0; r < rounds; r++ {
+		m := maskRounds[r]
+		block16Generic(s, &input, &offs, m.mask, int(64*m.rounds))
+		for j := range offs {
+			offs[j] += int(64 * m.rounds) // update offsets for next round
+		}
+	}
+	return rounds
+}
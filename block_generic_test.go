@@ -0,0 +1,67 @@
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// pad returns msg with MD5 padding appended.
+func pad(msg []byte) []byte {
+	p := append([]byte{}, msg...)
+	p = append(p, 0x80)
+	for len(p)%BlockSize != BlockSize-8 {
+		p = append(p, 0)
+	}
+	var l [8]byte
+	binary.LittleEndian.PutUint64(l[:], uint64(len(msg))<<3)
+	return append(p, l[:]...)
+}
+
+func TestBlockGeneric16(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	for iter := 0; iter < 50; iter++ {
+		var msgs, input [16][]byte
+		var s digest16
+		for i := range input {
+			s.v0[i], s.v1[i], s.v2[i], s.v3[i] = init0, init1, init2, init3
+			if rng.Intn(4) == 0 {
+				// Leave lane unused
+				continue
+			}
+			msgs[i] = make([]byte, rng.Intn(2000))
+			rng.Read(msgs[i])
+			input[i] = pad(msgs[i])
+		}
+		var mr [16]maskRounds
+		blockGeneric16(&s, input, &mr)
+
+		for i := range input {
+			got := [4]uint32{s.v0[i], s.v1[i], s.v2[i], s.v3[i]}
+			if input[i] == nil {
+				if got != [4]uint32{init0, init1, init2, init3} {
+					t.Errorf("unused lane %d was changed", i)
+				}
+				continue
+			}
+			var gotSum [Size]byte
+			for j, v := range got {
+				binary.LittleEndian.PutUint32(gotSum[4*j:], v)
+			}
+			if want := md5.Sum(msgs[i]); gotSum != want {
+				t.Errorf("lane %d: got %x, want %x", i, gotSum, want)
+			}
+
+			dig := [4]uint32{init0, init1, init2, init3}
+			blockGeneric(&dig, input[i])
+			if dig != got {
+				t.Errorf("lane %d: scalar got %x, want %x", i, dig, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+//go:build !noasm && !appengine && gc
+// +build !noasm,!appengine,gc
+
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sync"
+)
+
+// batchArenas contains staging buffers for inputs of SumBatch and Blocks
+// that lie too far apart for the kernels.
+// The layout matches the arena of md5Server buffers, so all lanes can be addressed
+// with 32 bit offsets from the base.
+var batchArenas = sync.Pool{New: func() interface{} {
+	b := make([]byte, 32+Lanes*internalBlockSize)
+	return &b
+}}
+
+// SumBatch returns the MD5 digests of up to 16 complete messages.
+// The messages are hashed in parallel on the calling goroutine,
+// so no Server is needed. Digests beyond len(msgs) are left zero.
+// SumBatch panics if more than 16 messages are supplied.
+func SumBatch(msgs [][]byte) (digests [16][Size]byte) {
+	if len(msgs) > Lanes {
+		panic("md5simd: SumBatch supports at most 16 messages")
+	}
+	if !hasAVX2 {
+		for i, msg := range msgs {
+			digests[i] = md5.Sum(msg)
+		}
+		return digests
+	}
+
+	var d digest16
+	for i := range d.v0 {
+		d.v0[i], d.v1[i], d.v2[i], d.v3[i] = init0, init1, init2, init3
+	}
+	var inputs [16][]byte
+	copy(inputs[:], msgs)
+	blocksMulti(&d, inputs)
+
+	// Padding.  Add a 1 bit and 0 bits until 56 bytes mod 64, followed by the length in bits.
+	var trailers [16][2 * BlockSize]byte
+	for i, msg := range msgs {
+		n := copy(trailers[i][:], msg[len(msg)&^(BlockSize-1):])
+		trailers[i][n] = 0x80
+		end := BlockSize
+		if n >= BlockSize-8 {
+			end += BlockSize
+		}
+		binary.LittleEndian.PutUint64(trailers[i][end-8:], uint64(len(msg))<<3)
+		inputs[i] = trailers[i][:end]
+	}
+	blocksMulti(&d, inputs)
+
+	for i := range msgs {
+		binary.LittleEndian.PutUint32(digests[i][0:], d.v0[i])
+		binary.LittleEndian.PutUint32(digests[i][4:], d.v1[i])
+		binary.LittleEndian.PutUint32(digests[i][8:], d.v2[i])
+		binary.LittleEndian.PutUint32(digests[i][12:], d.v3[i])
+	}
+	return digests
+}
+
+// Blocks updates the state of each lane with all blocks of the matching input.
+// Up to 16 lanes can be processed, and each input must be a multiple of BlockSize.
+// Inputs are hashed as-is; chaining and padding are left to the caller.
+// The initial state of a new hash is {0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}.
+// The backend that processed the blocks is returned.
+func Blocks(states [][4]uint32, inputs [][]byte) (Backend, error) {
+	if err := checkBlocks(states, inputs); err != nil {
+		return 0, err
+	}
+	var active int
+	for _, in := range inputs {
+		if len(in) > 0 {
+			active++
+		}
+	}
+	if !hasAVX2 || active < useScalarBelow {
+		for i, in := range inputs {
+			blockScalar(&states[i], in)
+		}
+		return BackendScalarAsm, nil
+	}
+
+	var d digest16
+	var in16 [16][]byte
+	for i := range states {
+		d.v0[i], d.v1[i], d.v2[i], d.v3[i] = states[i][0], states[i][1], states[i][2], states[i][3]
+		in16[i] = inputs[i]
+	}
+	blocksMulti(&d, in16)
+	for i := range states {
+		states[i] = [4]uint32{d.v0[i], d.v1[i], d.v2[i], d.v3[i]}
+	}
+	if hasAVX512 {
+		return BackendAVX512, nil
+	}
+	return BackendAVX2, nil
+}
+
+// blocksMulti hashes all complete blocks of each input into the matching lane of d.
+// The kernels address lanes with 32 bit offsets from a common base,
+// so inputs that lie too far apart are hashed with blocksStaged.
+// Requires AVX2.
+func blocksMulti(d *digest16, inputs [16][]byte) {
+	var full int
+	for i, in := range inputs {
+		inputs[i] = in[:len(in)&^(BlockSize-1)]
+		full |= len(inputs[i])
+	}
+	if full == 0 {
+		return
+	}
+	if _, ok := laneBase(inputs[:]); ok {
+		blocksLanes(d, inputs)
+		return
+	}
+	blocksStaged(d, inputs)
+}
+
+// blocksStaged is like blocksMulti, but copies the inputs into a staging arena
+// in chunks of up to internalBlockSize, so they fit 32 bit offsets.
+func blocksStaged(d *digest16, inputs [16][]byte) {
+	arena := batchArenas.Get().(*[]byte)
+	defer batchArenas.Put(arena)
+
+	for {
+		var staged [16][]byte
+		var used bool
+		for i, in := range inputs {
+			n := len(in) &^ (BlockSize - 1)
+			if n > internalBlockSize {
+				n = internalBlockSize
+			}
+			if n == 0 {
+				continue
+			}
+			s := 32 + i*internalBlockSize
+			staged[i] = (*arena)[s : s+n : s+n]
+			copy(staged[i], in)
+			inputs[i] = in[n:]
+			used = true
+		}
+		if !used {
+			return
+		}
+
+		// The staged lanes all lie in the arena, so they fit 32 bit offsets.
+		blocksLanes(d, staged)
+	}
+}
+
+// blocksLanes runs the kernels on lanes, which must be whole blocks
+// that fit 32 bit offsets, see laneBase.
+func blocksLanes(d *digest16, lanes [16][]byte) {
+	if hasAVX512 {
+		var mr16 [16]maskRounds
+		blockMd5_avx512(d, lanes, &mr16)
+		return
+	}
+	var mr8 [8]maskRounds
+	for h := 0; h < 2; h++ {
+		var d8 digest8
+		var i8 [8][]byte
+		var used bool
+		for i := range d8.v0 {
+			j := i + 8*h
+			d8.v0[i], d8.v1[i], d8.v2[i], d8.v3[i] = d.v0[j], d.v1[j], d.v2[j], d.v3[j]
+			i8[i] = lanes[j]
+			used = used || len(lanes[j]) > 0
+		}
+		if !used {
+			continue
+		}
+		blockMd5_avx2(&d8, i8, &mr8)
+		for i := range d8.v0 {
+			j := i + 8*h
+			d.v0[j], d.v1[j], d.v2[j], d.v3[j] = d8.v0[i], d8.v1[i], d8.v2[i], d8.v3[i]
+		}
+	}
+}
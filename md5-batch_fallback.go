@@ -0,0 +1,39 @@
+//+build !amd64 appengine !gc noasm
+
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"crypto/md5"
+)
+
+// SumBatch returns the MD5 digests of up to 16 complete messages.
+// Digests beyond len(msgs) are left zero.
+// SumBatch panics if more than 16 messages are supplied.
+func SumBatch(msgs [][]byte) (digests [16][Size]byte) {
+	if len(msgs) > 16 {
+		panic("md5simd: SumBatch supports at most 16 messages")
+	}
+	for i, msg := range msgs {
+		digests[i] = md5.Sum(msg)
+	}
+	return digests
+}
+
+// Blocks updates the state of each lane with all blocks of the matching input.
+// Up to 16 lanes can be processed, and each input must be a multiple of BlockSize.
+// Inputs are hashed as-is; chaining and padding are left to the caller.
+// The initial state of a new hash is {0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}.
+// The backend that processed the blocks is returned.
+func Blocks(states [][4]uint32, inputs [][]byte) (Backend, error) {
+	if err := checkBlocks(states, inputs); err != nil {
+		return 0, err
+	}
+	for i, in := range inputs {
+		blockScalar(&states[i], in)
+	}
+	return BackendGeneric, nil
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bufferPool hands out the buffers hashers send to the server.
+//
+// All buffers are sliced from a single arena, since the assembly
+// addresses lanes with 32 bit offsets from its start.
+// The arena is allocated when the first buffer is needed and buffers
+// are carved from it on demand. If idle is set, the arena is released
+// once all buffers have been returned and none was taken for that long.
+type bufferPool struct {
+	mu     sync.Mutex
+	arena  []byte   // nil when released.
+	carved int      // Number of buffers sliced from the arena, changed with mu held.
+	free   [][]byte // Returned buffers, changed with mu held.
+
+	waiters int           // Number of callers waiting for ready, changed with mu held.
+	ready   chan struct{} // Signalled when a buffer is returned while callers wait.
+
+	holders int32 // Number of buffers held by hashers accumulating writes.
+
+	size  int           // Size of each buffer.
+	max   int           // Maximum number of buffers.
+	idle  time.Duration // Release the arena after this long unused, if > 0.
+	timer *time.Timer
+	stats *serverStats
+	debug bufferDebug // Ownership of the buffers, with the md5simd_debug build tag.
+}
+
+func newBufferPool(size, max int, idle time.Duration, stats *serverStats) *bufferPool {
+	p := &bufferPool{
+		size:  size,
+		max:   max,
+		idle:  idle,
+		ready: make(chan struct{}, 1),
+		stats: stats,
+	}
+	if idle > 0 {
+		p.timer = time.AfterFunc(time.Hour, p.release)
+		p.timer.Stop()
+	}
+	return p
+}
+
+// get returns a free buffer, waiting for one if needed.
+func (p *bufferPool) get() []byte {
+	buf, _ := p.getContext(context.Background())
+	return buf
+}
+
+// getContext is like get, but gives up when ctx is done.
+// A nil ctx does not wait, and returns ErrWouldBlock if there is no free buffer.
+func (p *bufferPool) getContext(ctx context.Context) ([]byte, error) {
+	if buf := p.tryGet(); buf != nil {
+		return buf, nil
+	}
+	if ctx == nil {
+		return nil, ErrWouldBlock
+	}
+	start := time.Now()
+	p.mu.Lock()
+	for {
+		buf := p.take()
+		if buf != nil {
+			if p.waiters > 0 && len(p.free) > 0 {
+				// Pass the signal on, it may have been meant for both of us.
+				p.signal()
+			}
+			p.mu.Unlock()
+			p.stats.addBufferWait(time.Since(start))
+			if debugChecks {
+				p.debugTake(buf)
+			}
+			return buf, nil
+		}
+		p.waiters++
+		p.mu.Unlock()
+		select {
+		case <-p.ready:
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.waiters--
+			p.mu.Unlock()
+			return nil, ctx.Err()
+		}
+		p.mu.Lock()
+		p.waiters--
+	}
+}
+
+// take returns a returned buffer or carves a new one, with mu held.
+// nil is returned if all buffers are in use.
+func (p *bufferPool) take() []byte {
+	if n := len(p.free); n > 0 {
+		buf := p.free[n-1]
+		p.free[n-1] = nil
+		p.free = p.free[:n-1]
+		return buf
+	}
+	return p.carve()
+}
+
+// tryGet returns a free buffer, or nil if there is none.
+func (p *bufferPool) tryGet() []byte {
+	p.mu.Lock()
+	buf := p.take()
+	p.mu.Unlock()
+	if debugChecks && buf != nil {
+		p.debugTake(buf)
+	}
+	return buf
+}
+
+// exhausted reports whether get would have to wait.
+func (p *bufferPool) exhausted() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.free) == 0 && p.carved == p.max
+}
+
+// hold reserves the right to keep a buffer while accumulating writes.
+// At most half the buffers can be held, so the rest keeps circulating.
+// false is returned if no more buffers can be held.
+func (p *bufferPool) hold() bool {
+	for {
+		n := atomic.LoadInt32(&p.holders)
+		if int(n) >= p.max/2 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&p.holders, n, n+1) {
+			return true
+		}
+	}
+}
+
+// unhold releases a reservation made by hold.
+func (p *bufferPool) unhold() {
+	atomic.AddInt32(&p.holders, -1)
+}
+
+// carve slices a new buffer from the arena, allocating it if needed.
+// nil is returned if the budget is used up. mu must be held.
+func (p *bufferPool) carve() []byte {
+	if p.carved == p.max {
+		return nil
+	}
+	if p.arena == nil {
+		// Leave 32 bytes in front, so no lane has offset 0.
+		p.arena = make([]byte, 32+p.max*p.size)
+	}
+	s := 32 + p.carved*p.size
+	p.carved++
+	atomic.AddInt64(&p.stats.bufferBytes, int64(p.size))
+	return p.arena[s : s+p.size : s+p.size]
+}
+
+// put returns a buffer to the pool.
+func (p *bufferPool) put(buf []byte) {
+	if debugChecks {
+		p.debugPut(buf)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.free = append(p.free, buf)
+	if p.waiters > 0 {
+		p.signal()
+	}
+	if p.timer != nil && len(p.free) == p.carved {
+		// All buffers are home, release them if they stay there.
+		p.timer.Reset(p.idle)
+	}
+}
+
+// signal wakes a caller waiting for a buffer, with mu held.
+// A pending signal is enough, since the woken caller passes it on.
+func (p *bufferPool) signal() {
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+// base returns the arena buffers are sliced from.
+// Buffers held by the caller keep the arena from being released.
+func (p *bufferPool) base() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.arena
+}
+
+// release drops the arena if all carved buffers are free.
+func (p *bufferPool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.arena == nil || len(p.free) != p.carved {
+		return
+	}
+	p.arena = nil
+	p.free = nil
+	p.carved = 0
+	atomic.StoreInt64(&p.stats.bufferBytes, 0)
+	atomic.AddUint64(&p.stats.bufferReleases, 1)
+}
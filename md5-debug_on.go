@@ -0,0 +1,165 @@
+//+build md5simd_debug
+
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// debugChecks enables the invariant checks of the md5simd_debug build tag.
+// Every buffer is tracked from the moment it is taken from the pool until it is returned,
+// blocks are checked to be aligned and inside their buffer, and every SIMD round
+// is compared to blockScalar on the same input.
+const debugChecks = true
+
+// invariantError is the panic value of a failed invariant check.
+// The server does not recover from it, since it means the package is broken.
+type invariantError string
+
+func (e invariantError) Error() string {
+	return "md5simd: invariant violated: " + string(e)
+}
+
+func invariantf(format string, args ...interface{}) {
+	panic(invariantError(fmt.Sprintf(format, args...)))
+}
+
+// repanicInvariant panics again with r if it is a failed invariant check.
+func repanicInvariant(r interface{}) {
+	if _, ok := r.(invariantError); ok {
+		panic(r)
+	}
+}
+
+// bufferDebug tracks which buffers of a pool are taken.
+type bufferDebug struct {
+	mu    sync.Mutex
+	taken map[int][]uintptr // Callers that took the buffer, by index in the arena.
+}
+
+// index returns the index of the buffer buf starts, checking that it is one of ours.
+func (p *bufferPool) index(buf []byte) int {
+	arena := p.base()
+	if arena == nil {
+		invariantf("buffer used while the arena is released")
+	}
+	if cap(buf) == 0 {
+		invariantf("empty buffer")
+	}
+	start := uintptr(unsafe.Pointer(&arena[0]))
+	ptr := uintptr(unsafe.Pointer(&buf[:1][0]))
+	if ptr < start || ptr+uintptr(cap(buf)) > start+uintptr(len(arena)) {
+		invariantf("buffer at %#x is outside the arena at %#x", ptr, start)
+	}
+	off := int(ptr - start)
+	if off < 32 || (off-32)%p.size != 0 || cap(buf) != p.size {
+		invariantf("slice at offset %d with capacity %d is not a buffer of %d bytes", off, cap(buf), p.size)
+	}
+	return (off - 32) / p.size
+}
+
+// debugTake records that buf was taken from the pool.
+func (p *bufferPool) debugTake(buf []byte) {
+	i := p.index(buf)
+	d := &p.debug
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.taken == nil {
+		d.taken = make(map[int][]uintptr)
+	}
+	if pcs, ok := d.taken[i]; ok {
+		invariantf("buffer %d taken twice, first by:\n%s", i, formatCallers(pcs))
+	}
+	pcs := make([]uintptr, 16)
+	d.taken[i] = pcs[:runtime.Callers(3, pcs)]
+}
+
+// debugPut records that buf was returned to the pool.
+func (p *bufferPool) debugPut(buf []byte) {
+	i := p.index(buf)
+	d := &p.debug
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.taken[i]; !ok {
+		invariantf("buffer %d returned twice", i)
+	}
+	delete(d.taken, i)
+}
+
+// debugOwned checks that buf was taken from the pool.
+func (p *bufferPool) debugOwned(buf []byte) {
+	i := p.index(buf)
+	d := &p.debug
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.taken[i]; !ok {
+		invariantf("buffer %d is used while it is in the pool", i)
+	}
+}
+
+// debugLeaks checks that all buffers are back in the pool.
+func (p *bufferPool) debugLeaks() {
+	d := &p.debug
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.taken) == 0 {
+		return
+	}
+	var b strings.Builder
+	for i, pcs := range d.taken {
+		fmt.Fprintf(&b, "buffer %d taken by:\n%s", i, formatCallers(pcs))
+	}
+	invariantf("%d buffers were not returned:\n%s", len(d.taken), b.String())
+}
+
+// checkLanes checks the blocks of a round before they are hashed.
+func (s *md5Server) checkLanes(lanes []blockInput) {
+	slots := make(map[int]bool, len(lanes))
+	for i, lane := range lanes {
+		if lane.cl == nil {
+			invariantf("lane %d has no client", i)
+		}
+		if slots[lane.cl.slot] {
+			invariantf("lane %d shares state slot %d with another lane", i, lane.cl.slot)
+		}
+		slots[lane.cl.slot] = true
+		if len(lane.msg) == 0 || len(lane.msg)%BlockSize != 0 {
+			invariantf("lane %d has %d bytes, not a multiple of %d", i, len(lane.msg), BlockSize)
+		}
+		s.buffers.debugOwned(lane.msg)
+	}
+}
+
+// verifyRound checks the digests of a SIMD round against blockScalar.
+// before holds the digests of the lanes before the round, after the result.
+func (s *md5Server) verifyRound(lanes []blockInput, before, after *digest16) {
+	for i, lane := range lanes {
+		want := [4]uint32{before.v0[i], before.v1[i], before.v2[i], before.v3[i]}
+		blockScalar(&want, lane.msg)
+		got := [4]uint32{after.v0[i], after.v1[i], after.v2[i], after.v3[i]}
+		if got != want {
+			invariantf("lane %d of %d in a %v round: got %08x, blockScalar %08x", i, len(lanes), s.backend, got, want)
+		}
+	}
+}
+
+func formatCallers(pcs []uintptr) string {
+	var b strings.Builder
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
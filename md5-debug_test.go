@@ -0,0 +1,66 @@
+//+build md5simd_debug
+
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"testing"
+)
+
+// mustViolate checks that f fails an invariant check.
+func mustViolate(t *testing.T, what string, f func()) {
+	t.Helper()
+	defer func() {
+		t.Helper()
+		r := recover()
+		if _, ok := r.(invariantError); !ok {
+			t.Errorf("%s: got panic %v, want an invariant violation", what, r)
+		}
+	}()
+	f()
+}
+
+func TestDebugBuffers(t *testing.T) {
+	var st serverStats
+	p := newBufferPool(4*BlockSize, 4, 0, &st)
+	buf := p.get()
+	p.put(buf[:BlockSize])
+	mustViolate(t, "double return", func() { p.put(buf) })
+	mustViolate(t, "foreign buffer", func() { p.put(make([]byte, 4*BlockSize)) })
+	buf = p.get()
+	mustViolate(t, "unaligned buffer", func() { p.put(buf[BlockSize:]) })
+	mustViolate(t, "leak", p.debugLeaks)
+	p.put(buf)
+	p.debugLeaks()
+}
+
+func TestDebugLanes(t *testing.T) {
+	opts, backend, err := resolveOptions(ServerOptions{Backend: BackendGeneric, ChunkSize: 4 * BlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(opts, backend)
+	defer s.Close()
+
+	buf := s.buffers.get()
+	lanes := []blockInput{{cl: &client{slot: 0}, msg: buf[:BlockSize]}}
+	s.checkLanes(lanes)
+	mustViolate(t, "unaligned length", func() {
+		s.checkLanes([]blockInput{{cl: &client{}, msg: buf[:BlockSize+1]}})
+	})
+	mustViolate(t, "shared slot", func() {
+		s.checkLanes(append(lanes, blockInput{cl: &client{slot: 0}, msg: buf[:BlockSize]}))
+	})
+	s.buffers.put(buf)
+	mustViolate(t, "free buffer", func() { s.checkLanes(lanes) })
+
+	before := digest16{}
+	after := before
+	after.v0[0] = 1
+	mustViolate(t, "wrong digest", func() {
+		s.verifyRound([]blockInput{{msg: make([]byte, BlockSize)}}, &before, &after)
+	})
+}
@@ -0,0 +1,874 @@
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// md5Digest - Type for computing MD5 using either AVX2 or AVX512
+type md5Digest struct {
+	cl       *client // Server side state, nil when closed.
+	x        [BlockSize]byte
+	nx       int
+	acc      []byte // Buffer accumulating small writes. If set, nx is 0.
+	len      uint64
+	buffers  *bufferPool
+	server   *md5Server
+	pool     *ServerPool // If set, the hash may move to another server on Reset.
+	priority Priority
+	rec      *hasherRecord // Set if the server tracks hashers.
+}
+
+// NewHash - initialize instance for Md5 implementation.
+func (s *md5Server) NewHash() Hasher {
+	return s.NewHashWithOptions(HashOptions{})
+}
+
+// NewHashWithOptions returns a hasher using the supplied options.
+// If the server is closed, all operations of the hasher fail with ErrServerClosed.
+func (s *md5Server) NewHashWithOptions(opts HashOptions) Hasher {
+	d := &md5Digest{priority: opts.Priority.class()}
+	s.register(d)
+	return d
+}
+
+// NewHashErr is like NewHashWithOptions, but returns ErrServerClosed if the server is closed.
+func (s *md5Server) NewHashErr(opts HashOptions) (Hasher, error) {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return nil, ErrServerClosed
+	}
+	return s.NewHashWithOptions(opts), nil
+}
+
+// register adds d as a new client of the server.
+func (s *md5Server) register(d *md5Digest) {
+	cl := &client{priority: d.priority}
+	atomic.AddInt64(&s.stats.clients, 1)
+	s.ring.send(blockInput{op: opRegister, cl: cl})
+	d.cl = cl
+	d.buffers = s.buffers
+	d.server = s
+	s.track(d)
+}
+
+// unregister removes d from its server.
+func (d *md5Digest) unregister() {
+	// The server reuses the state slot once queued blocks are done.
+	d.sendBlock(blockInput{op: opClose})
+	d.cl = nil
+	atomic.AddInt64(&d.server.stats.clients, -1)
+	if d.rec != nil {
+		d.server.tracker.remove(d.rec)
+	}
+}
+
+// check returns the error operations on d fail with, or nil if d can be used.
+func (d *md5Digest) check() error {
+	if d.rec != nil {
+		d.rec.touch()
+	}
+	switch {
+	case d.cl == nil:
+		return ErrHasherClosed
+	case atomic.LoadInt32(&d.server.closed) != 0:
+		return ErrServerClosed
+	}
+	return d.cl.failure()
+}
+
+// Size - Return size of checksum
+func (d *md5Digest) Size() int { return Size }
+
+// BlockSize - Return blocksize of checksum
+func (d md5Digest) BlockSize() int { return BlockSize }
+
+// Reset resets the hash. It panics if the hasher is closed.
+// Use ResetErr to find out whether the hasher can be used afterwards.
+func (d *md5Digest) Reset() {
+	if err := d.ResetErr(); err == ErrHasherClosed {
+		panic(err)
+	}
+}
+
+// ResetErr resets the hash, or returns why the hasher cannot be used.
+// A hasher that failed with ErrInternal can be used again after a reset.
+func (d *md5Digest) ResetErr() error {
+	if d.rec != nil {
+		d.rec.touch()
+	}
+	if d.cl == nil {
+		return ErrHasherClosed
+	}
+	if atomic.LoadInt32(&d.server.closed) != 0 {
+		return ErrServerClosed
+	}
+	d.drop()
+	d.nx = 0
+	d.len = 0
+	s := d.server
+	if d.pool != nil {
+		s = d.pool.rebalance(d.server)
+	}
+	if s != d.server || d.cl.failure() != nil {
+		// The state is reset, so we can start over with a new client.
+		d.unregister()
+		s.register(d)
+		return nil
+	}
+	d.sendBlock(blockInput{reset: true})
+	return nil
+}
+
+// write to digest
+func (d *md5Digest) Write(p []byte) (nn int, err error) {
+	if err := d.check(); err != nil {
+		return 0, err
+	}
+
+	// break input into chunks of maximum ChunkSize size
+	chunkSize := d.server.options.ChunkSize
+	for {
+		if d.acc == nil && d.nx+len(p) >= BlockSize && len(p) < d.server.options.FlushThreshold {
+			d.startCoalescing()
+		}
+		if d.acc != nil {
+			n, err := d.coalesce(p)
+			nn += n
+			if err != nil {
+				return nn, err
+			}
+			p = p[n:]
+			if len(p) == 0 {
+				break
+			}
+			continue
+		}
+
+		l := len(p)
+		if l > chunkSize {
+			l = chunkSize
+		}
+		nnn, err := d.write(p[:l])
+		if err != nil {
+			return nn, err
+		}
+		nn += nnn
+		p = p[l:]
+
+		if len(p) == 0 {
+			break
+		}
+
+	}
+	return
+}
+
+func (d *md5Digest) write(p []byte) (nn int, err error) {
+
+	nn = len(p)
+	d.advance(nn)
+	if d.nx > 0 {
+		n := copy(d.x[d.nx:], p)
+		d.nx += n
+		if d.nx == BlockSize {
+			// Create a copy of the overflow buffer in order to send it async over the channel
+			// (since we will modify the overflow buffer down below with any access beyond multiples of 64)
+			tmp := d.getBuffer()
+			tmp = tmp[:BlockSize]
+			copy(tmp, d.x[:])
+			d.nx = 0
+			if err := d.sendBlock(blockInput{msg: tmp}); err != nil {
+				return 0, err
+			}
+		}
+		p = p[n:]
+	}
+	if len(p) >= BlockSize {
+		n := len(p) &^ (BlockSize - 1)
+		buf := d.getBuffer()
+		buf = buf[:n]
+		copy(buf, p)
+		if err := d.sendBlock(blockInput{msg: buf}); err != nil {
+			return 0, err
+		}
+		p = p[n:]
+	}
+	if len(p) > 0 {
+		d.nx = copy(d.x[:], p)
+	}
+	return
+}
+
+// startCoalescing checks out a buffer to accumulate small writes in.
+// Only half of the buffers can be held this way, so hashers
+// that are not written to cannot starve the others.
+func (d *md5Digest) startCoalescing() {
+	if !d.buffers.hold() {
+		return
+	}
+	d.acc = append(d.getBuffer()[:0], d.x[:d.nx]...)
+	d.nx = 0
+}
+
+// tryCoalescing is like startCoalescing, but does not wait for a buffer.
+func (d *md5Digest) tryCoalescing() {
+	if !d.buffers.hold() {
+		return
+	}
+	buf := d.buffers.tryGet()
+	if buf == nil {
+		d.buffers.unhold()
+		return
+	}
+	d.acc = append(buf[:0], d.x[:d.nx]...)
+	d.nx = 0
+}
+
+// coalesce adds as much of p as fits to the accumulated writes
+// and returns the number of bytes added.
+// The writes are sent to the server once FlushThreshold is reached.
+func (d *md5Digest) coalesce(p []byte) (int, error) {
+	flushAt := d.server.options.FlushThreshold
+	n := copy(d.acc[len(d.acc):flushAt], p)
+	d.acc = d.acc[:len(d.acc)+n]
+	d.advance(n)
+	if len(d.acc) == flushAt {
+		return n, d.flush()
+	}
+	return n, nil
+}
+
+// flush sends the whole blocks of accumulated writes to the server.
+// The remainder is kept in d.x.
+func (d *md5Digest) flush() (err error) {
+	if d.acc == nil {
+		return nil
+	}
+	aligned := len(d.acc) &^ (BlockSize - 1)
+	d.nx = copy(d.x[:], d.acc[aligned:])
+	if aligned > 0 {
+		err = d.sendBlock(blockInput{msg: d.acc[:aligned]})
+	} else {
+		d.buffers.put(d.acc)
+	}
+	d.acc = nil
+	d.buffers.unhold()
+	return err
+}
+
+// flushContext is like flush, but gives up when ctx is done,
+// keeping the accumulated writes.
+// A nil ctx does not wait, and returns ErrWouldBlock if the server has no room.
+func (d *md5Digest) flushContext(ctx context.Context) error {
+	if d.acc == nil {
+		return nil
+	}
+	aligned := len(d.acc) &^ (BlockSize - 1)
+	if aligned > 0 {
+		if err := d.server.ring.sendContext(ctx, blockInput{cl: d.cl, msg: d.acc[:aligned]}); err != nil {
+			return err
+		}
+	}
+	d.nx = copy(d.x[:], d.acc[aligned:])
+	if aligned == 0 {
+		d.buffers.put(d.acc)
+	}
+	d.acc = nil
+	d.buffers.unhold()
+	return nil
+}
+
+// coalesceContext is like coalesce, but flushes with flushContext.
+// Full accumulated writes are flushed before more are added,
+// so nothing is added if the flush fails.
+func (d *md5Digest) coalesceContext(ctx context.Context, p []byte) (int, error) {
+	flushAt := d.server.options.FlushThreshold
+	if len(d.acc) == flushAt {
+		return 0, d.flushContext(ctx)
+	}
+	n := copy(d.acc[len(d.acc):flushAt], p)
+	d.acc = d.acc[:len(d.acc)+n]
+	d.advance(n)
+	return n, nil
+}
+
+// drop discards the accumulated writes.
+func (d *md5Digest) drop() {
+	if d.acc != nil {
+		d.buffers.put(d.acc)
+		d.acc = nil
+		d.buffers.unhold()
+	}
+}
+
+// WriteBuffers writes all slices in bufs to the hash.
+// The slices are copied straight into as few server buffers as possible,
+// so many small slices cost no more than a single large write.
+// Like Write, slices smaller than FlushThreshold in total are collected first.
+func (d *md5Digest) WriteBuffers(bufs net.Buffers) (n int64, err error) {
+	if err := d.check(); err != nil {
+		return 0, err
+	}
+
+	var total int
+	for _, p := range bufs {
+		total += len(p)
+	}
+	if d.acc == nil && d.nx+total >= BlockSize && total < d.server.options.FlushThreshold {
+		d.startCoalescing()
+	}
+	if d.acc != nil {
+		for _, p := range bufs {
+			m, err := d.Write(p)
+			n += int64(m)
+			if err != nil {
+				return n, err
+			}
+		}
+		return n, nil
+	}
+
+	chunkSize := d.server.options.ChunkSize
+	// buf is the buffer being filled, nil until there is a full block.
+	var buf []byte
+	for _, p := range bufs {
+		n += int64(len(p))
+		d.advance(len(p))
+		for len(p) > 0 {
+			if buf == nil {
+				if d.nx+len(p) < BlockSize {
+					d.nx += copy(d.x[d.nx:], p)
+					break
+				}
+				buf = append(d.getBuffer()[:0], d.x[:d.nx]...)
+				d.nx = 0
+			}
+			c := copy(buf[len(buf):chunkSize], p)
+			buf = buf[:len(buf)+c]
+			p = p[c:]
+			if len(buf) == chunkSize {
+				err := d.sendBlock(blockInput{msg: buf})
+				buf = nil
+				if err != nil {
+					return n, err
+				}
+			}
+		}
+	}
+	if buf != nil {
+		// Send whole blocks and keep the rest, like Write.
+		aligned := len(buf) &^ (BlockSize - 1)
+		d.nx = copy(d.x[:], buf[aligned:])
+		if aligned > 0 {
+			return n, d.sendBlock(blockInput{msg: buf[:aligned]})
+		}
+		d.buffers.put(buf)
+	}
+	return n, nil
+}
+
+// ReadFrom reads r until EOF and writes the data to the hash.
+// Data is read straight into server buffers, so io.Copy to a hasher
+// does not copy the data an extra time.
+func (d *md5Digest) ReadFrom(r io.Reader) (n int64, err error) {
+	if err := d.check(); err != nil {
+		return 0, err
+	}
+	// A buffer is kept while waiting for the reader, so it counts as held.
+	if d.acc == nil && !d.buffers.hold() {
+		return d.readFromCopy(r)
+	}
+
+	chunkSize := d.server.options.ChunkSize
+	// buf is the buffer being filled, nil until it is needed.
+	buf := d.acc
+	d.acc = nil
+	var werr error
+	for {
+		// A stopped server drops the blocks it is sent, so check before each chunk.
+		if werr = d.check(); werr != nil {
+			break
+		}
+		if buf == nil {
+			buf = append(d.getBuffer()[:0], d.x[:d.nx]...)
+			d.nx = 0
+		}
+		m, rerr := r.Read(buf[len(buf):chunkSize])
+		buf = buf[:len(buf)+m]
+		n += int64(m)
+		d.advance(m)
+		if len(buf) == chunkSize {
+			werr = d.sendBlockContext(context.Background(), blockInput{msg: buf})
+			buf = nil
+			if werr != nil {
+				break
+			}
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				err = rerr
+			}
+			break
+		}
+	}
+	if werr != nil {
+		if buf != nil {
+			d.buffers.put(buf)
+		}
+		d.buffers.unhold()
+		return n, werr
+	}
+	if buf != nil {
+		// Send whole blocks and keep the rest, like Write.
+		aligned := len(buf) &^ (BlockSize - 1)
+		d.nx = copy(d.x[:], buf[aligned:])
+		if aligned > 0 {
+			werr = d.sendBlockContext(context.Background(), blockInput{msg: buf[:aligned]})
+		} else {
+			d.buffers.put(buf)
+		}
+	}
+	d.buffers.unhold()
+	if werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// readFromCopy is ReadFrom using an intermediate buffer,
+// used when no more server buffers can be held.
+func (d *md5Digest) readFromCopy(r io.Reader) (n int64, err error) {
+	tmp := copyBufPool.Get().(*[internalBlockSize]byte)
+	defer copyBufPool.Put(tmp)
+	for {
+		m, rerr := r.Read(tmp[:])
+		w, werr := d.Write(tmp[:m])
+		n += int64(w)
+		if werr != nil {
+			return n, werr
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				err = rerr
+			}
+			return n, err
+		}
+	}
+}
+
+var copyBufPool = sync.Pool{New: func() interface{} {
+	return new([internalBlockSize]byte)
+}}
+
+// WriteString writes s to the hash without converting it to a new slice.
+func (d *md5Digest) WriteString(s string) (int, error) {
+	var b []byte
+	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
+	bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	bh.Data, bh.Len, bh.Cap = sh.Data, sh.Len, sh.Len
+	// Write copies b before returning, so s is never modified or retained.
+	return d.Write(b)
+}
+
+// TryWrite writes as much of p as possible without waiting for the server.
+// If not all of p was written ErrWouldBlock is returned.
+func (d *md5Digest) TryWrite(p []byte) (nn int, err error) {
+	return d.writeContext(nil, p)
+}
+
+// WriteContext is like Write, but gives up when ctx is done.
+// The number of bytes written before that is returned with ctx.Err().
+// The hash stays usable, so the rest of p can be written later.
+func (d *md5Digest) WriteContext(ctx context.Context, p []byte) (nn int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return d.writeContext(ctx, p)
+}
+
+// writeContext writes p, waiting for the server until ctx is done.
+// A nil ctx does not wait.
+func (d *md5Digest) writeContext(ctx context.Context, p []byte) (nn int, err error) {
+	if err := d.check(); err != nil {
+		return 0, err
+	}
+
+	chunkSize := d.server.options.ChunkSize
+	for len(p) > 0 {
+		if d.acc == nil && d.nx+len(p) >= BlockSize && len(p) < d.server.options.FlushThreshold {
+			d.tryCoalescing()
+		}
+		if d.acc != nil {
+			n, err := d.coalesceContext(ctx, p)
+			nn += n
+			if err != nil {
+				return nn, err
+			}
+			p = p[n:]
+			continue
+		}
+
+		l := len(p)
+		if l > chunkSize {
+			l = chunkSize
+		}
+		n, err := d.writeChunkContext(ctx, p[:l])
+		nn += n
+		if err != nil {
+			return nn, err
+		}
+		p = p[l:]
+	}
+	return nn, nil
+}
+
+// writeChunkContext writes up to a single chunk, like write.
+// Input is only consumed once the blocks it completes are queued.
+func (d *md5Digest) writeChunkContext(ctx context.Context, p []byte) (nn int, err error) {
+	if d.nx > 0 {
+		n := BlockSize - d.nx
+		if n > len(p) {
+			n = len(p)
+		}
+		if d.nx+n == BlockSize {
+			buf, err := d.buffers.getContext(ctx)
+			if err != nil {
+				return 0, err
+			}
+			buf = append(append(buf[:0], d.x[:d.nx]...), p[:n]...)
+			if err := d.sendBlockContext(ctx, blockInput{msg: buf}); err != nil {
+				return 0, err
+			}
+			d.nx = 0
+		} else {
+			d.nx += copy(d.x[d.nx:], p[:n])
+		}
+		d.advance(n)
+		nn += n
+		p = p[n:]
+	}
+	if len(p) >= BlockSize {
+		n := len(p) &^ (BlockSize - 1)
+		buf, err := d.buffers.getContext(ctx)
+		if err != nil {
+			return nn, err
+		}
+		buf = buf[:n]
+		copy(buf, p)
+		if err := d.sendBlockContext(ctx, blockInput{msg: buf}); err != nil {
+			return nn, err
+		}
+		d.advance(n)
+		nn += n
+		p = p[n:]
+	}
+	if len(p) > 0 {
+		d.nx = copy(d.x[:], p)
+		d.advance(d.nx)
+		nn += d.nx
+	}
+	return nn, nil
+}
+
+func (d *md5Digest) Close() {
+	if d.cl != nil {
+		d.drop()
+		d.unregister()
+		if d.rec != nil {
+			runtime.SetFinalizer(d, nil)
+		}
+	}
+}
+
+// getBuffer returns a free buffer, waiting for one if needed.
+func (d *md5Digest) getBuffer() []byte {
+	return d.buffers.get()
+}
+
+var sumChPool sync.Pool
+
+func init() {
+	sumChPool.New = func() interface{} {
+		return make(chan sumResult, 1)
+	}
+}
+
+// Sum - Return MD5 sum in bytes
+// It panics if the sum cannot be computed, use SumErr to get the error instead.
+func (d *md5Digest) Sum(in []byte) (result []byte) {
+	result, err := d.SumErr(in)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// SumErr is like Sum, but returns an error if the sum cannot be computed.
+func (d *md5Digest) SumErr(in []byte) ([]byte, error) {
+	if err := d.check(); err != nil {
+		return nil, err
+	}
+
+	if err := d.flush(); err != nil {
+		return nil, err
+	}
+	sumCh := sumChPool.Get().(chan sumResult)
+	if err := d.sendBlock(blockInput{msg: d.appendTrailer(d.getBuffer()[:0]), sumCh: sumCh}); err != nil {
+		sumChPool.Put(sumCh)
+		return nil, err
+	}
+
+	sum, err := d.waitSum(context.Background(), sumCh)
+	if err != nil {
+		return nil, err
+	}
+	return append(in, sum.digest[:]...), nil
+}
+
+// SumContext is like Sum, but gives up when ctx is done and returns ctx.Err().
+// The hash is not changed by an abandoned sum, so it can be written to,
+// summed again or reset afterwards.
+func (d *md5Digest) SumContext(ctx context.Context, in []byte) ([]byte, error) {
+	if err := d.check(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := d.flushContext(ctx); err != nil {
+		return nil, err
+	}
+	buf, err := d.buffers.getContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sumCh := sumChPool.Get().(chan sumResult)
+	if err := d.sendBlockContext(ctx, blockInput{msg: d.appendTrailer(buf[:0]), sumCh: sumCh}); err != nil {
+		sumChPool.Put(sumCh)
+		return nil, err
+	}
+
+	sum, err := d.waitSum(ctx, sumCh)
+	if err != nil {
+		return nil, err
+	}
+	return append(in, sum.digest[:]...), nil
+}
+
+// waitSum waits for the server to send a sum on sumCh and returns sumCh to the pool.
+// If ctx is done first ctx.Err() is returned, and sumCh is not reused,
+// since the server still sends the sum.
+func (d *md5Digest) waitSum(ctx context.Context, sumCh chan sumResult) (sumResult, error) {
+	select {
+	case sum := <-sumCh:
+		sumChPool.Put(sumCh)
+		return sum, sum.err
+	case <-d.server.done:
+		// The server answers everything it received before stopping.
+		select {
+		case sum := <-sumCh:
+			sumChPool.Put(sumCh)
+			return sum, sum.err
+		default:
+			return sumResult{}, ErrServerClosed
+		}
+	case <-ctx.Done():
+		return sumResult{}, ctx.Err()
+	}
+}
+
+// SumAsync starts computing the sum and returns without waiting for it.
+// The trailers of many hashers are processed in the same rounds,
+// so starting all sums before waiting for them is faster than calling Sum on each.
+// If the hasher cannot be used, the future fails with the error.
+func (d *md5Digest) SumAsync(in []byte) *SumFuture {
+	f := &SumFuture{in: in, done: make(chan struct{})}
+	if err := d.check(); err != nil {
+		f.err = err
+		close(f.done)
+		return f
+	}
+
+	err := d.flush()
+	if err == nil {
+		err = d.sendBlock(blockInput{msg: d.appendTrailer(d.getBuffer()[:0]), sum: f})
+	}
+	if err != nil {
+		f.err = err
+		close(f.done)
+	}
+	return f
+}
+
+// appendTrailer appends the final blocks of the hash to trail.
+// Accumulated writes must be flushed first.
+func (d *md5Digest) appendTrailer(trail []byte) []byte {
+	trail = append(trail, d.x[:d.nx]...)
+
+	length := d.len
+	// Padding.  Add a 1 bit and 0 bits until 56 bytes mod 64.
+	var tmp [64]byte
+	tmp[0] = 0x80
+	if length%64 < 56 {
+		trail = append(trail, tmp[0:56-length%64]...)
+	} else {
+		trail = append(trail, tmp[0:64+56-length%64]...)
+	}
+
+	// Length in bits.
+	length <<= 3
+	binary.LittleEndian.PutUint64(tmp[:], length) // append length in bits
+
+	trail = append(trail, tmp[0:8]...)
+	if len(trail)%BlockSize != 0 {
+		panic(fmt.Errorf("internal error: sum block was not aligned. len=%d, nx=%d", len(trail), d.nx))
+	}
+	return trail
+}
+
+// MarshalBinary returns the state of the hash in the crypto/md5 format.
+// All blocks queued for the hash are processed before the state is returned.
+func (d *md5Digest) MarshalBinary() ([]byte, error) {
+	if err := d.check(); err != nil {
+		return nil, err
+	}
+
+	sum, err := d.interimDigest()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, marshaledSize)
+	b = append(b, magic...)
+	for _, v := range sum {
+		b = appendUint32(b, v)
+	}
+	b = append(b, d.x[:d.nx]...)
+	b = b[:len(b)+len(d.x)-d.nx] // already zero
+	b = appendUint64(b, d.len)
+	return b, nil
+}
+
+// UnmarshalBinary restores a state produced by MarshalBinary,
+// either from a Hasher or from crypto/md5.
+func (d *md5Digest) UnmarshalBinary(b []byte) error {
+	if err := d.check(); err != nil {
+		return err
+	}
+	if len(b) < len(magic) || string(b[:len(magic)]) != magic {
+		return errors.New("md5simd: invalid hash state identifier")
+	}
+	if len(b) != marshaledSize {
+		return errors.New("md5simd: invalid hash state size")
+	}
+	b = b[len(magic):]
+	var state [4]uint32
+	for i := range state {
+		state[i] = binary.BigEndian.Uint32(b)
+		b = b[4:]
+	}
+	d.drop()
+	copy(d.x[:], b[:BlockSize])
+	b = b[BlockSize:]
+	d.len = binary.BigEndian.Uint64(b)
+	d.nx = int(d.len % BlockSize)
+	d.sendBlock(blockInput{reset: true, state: &state})
+	return nil
+}
+
+// Clone returns an independent copy of the hash, registered with the same server.
+// All blocks queued for the hash are processed before the state is copied.
+// It panics if the hash cannot be copied, use CloneErr to get the error instead.
+func (d *md5Digest) Clone() Hasher {
+	c, err := d.CloneErr()
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// CloneErr is like Clone, but returns an error if the hash cannot be copied.
+func (d *md5Digest) CloneErr() (Hasher, error) {
+	if err := d.check(); err != nil {
+		return nil, err
+	}
+	state, err := d.interimDigest()
+	if err != nil {
+		return nil, err
+	}
+	c := d.server.NewHashWithOptions(HashOptions{Priority: d.priority}).(*md5Digest)
+	c.pool = d.pool
+	c.x, c.nx, c.len = d.x, d.nx, d.len
+	c.sendBlock(blockInput{reset: true, state: &state})
+	return c, nil
+}
+
+// interimDigest returns the digest state held by the server,
+// after all queued blocks have been processed.
+func (d *md5Digest) interimDigest() (state [4]uint32, err error) {
+	if err := d.flush(); err != nil {
+		return state, err
+	}
+	// A sum request without a trailer returns the interim digest.
+	sumCh := sumChPool.Get().(chan sumResult)
+	if err := d.sendBlock(blockInput{sumCh: sumCh}); err != nil {
+		sumChPool.Put(sumCh)
+		return state, err
+	}
+	sum, err := d.waitSum(context.Background(), sumCh)
+	if err != nil {
+		return state, err
+	}
+	for i := range state {
+		state[i] = binary.LittleEndian.Uint32(sum.digest[i*4:])
+	}
+	return state, nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var a [4]byte
+	binary.BigEndian.PutUint32(a[:], v)
+	return append(b, a[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var a [8]byte
+	binary.BigEndian.PutUint64(a[:], v)
+	return append(b, a[:]...)
+}
+
+// sendBlock will send a block for processing.
+// It only blocks if the submission ring is full.
+// If the server has stopped, its buffer is returned to the pool and ErrServerClosed is returned.
+func (d *md5Digest) sendBlock(bi blockInput) error {
+	bi.cl = d.cl
+	err := d.server.ring.send(bi)
+	if err != nil && bi.msg != nil {
+		d.buffers.put(bi.msg)
+	}
+	return err
+}
+
+// sendBlockContext is like sendBlock, but gives up when ctx is done.
+// A nil ctx does not wait. If the block is not sent, its buffer is returned to the pool.
+func (d *md5Digest) sendBlockContext(ctx context.Context, bi blockInput) error {
+	bi.cl = d.cl
+	err := d.server.ring.sendContext(ctx, bi)
+	if err != nil {
+		d.buffers.put(bi.msg)
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ServerPool is a Server that distributes hashers over multiple servers.
+// Since a server processes its lanes on a single goroutine,
+// a pool allows more than Lanes busy hashers to be processed in parallel.
+//
+// New hashers are placed on the server with the fewest active hashers.
+// When a hasher is Reset while its server has more than Lanes active hashers,
+// it is moved to a less loaded server if possible.
+type ServerPool struct {
+	servers  []*md5Server
+	fallback *fallbackServer // Used instead of servers when the options select the stdlib.
+}
+
+// NewServerPool creates a pool of n servers using the supplied options.
+// An error is returned if n is less than 1 or the options are invalid.
+func NewServerPool(n int, opts ServerOptions) (*ServerPool, error) {
+	if n < 1 {
+		return nil, errors.New("md5simd: a server pool needs at least 1 server")
+	}
+	opts, backend, err := resolveOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if backend == BackendStdlib {
+		return &ServerPool{fallback: &fallbackServer{}}, nil
+	}
+	p := &ServerPool{servers: make([]*md5Server, n)}
+	for i := range p.servers {
+		p.servers[i] = newServer(opts, backend)
+	}
+	return p, nil
+}
+
+// NewHash returns a hasher on the server with the fewest active hashers.
+func (p *ServerPool) NewHash() Hasher {
+	return p.NewHashWithOptions(HashOptions{})
+}
+
+// NewHashWithOptions returns a hasher using the supplied options
+// on the server with the fewest active hashers.
+func (p *ServerPool) NewHashWithOptions(opts HashOptions) Hasher {
+	if p.fallback != nil {
+		return p.fallback.NewHashWithOptions(opts)
+	}
+	d := &md5Digest{pool: p, priority: opts.Priority.class()}
+	p.leastLoaded().register(d)
+	return d
+}
+
+// NewHashErr is like NewHashWithOptions, but returns ErrServerClosed if the pool is closed.
+func (p *ServerPool) NewHashErr(opts HashOptions) (Hasher, error) {
+	if p.fallback != nil {
+		return p.fallback.NewHashErr(opts)
+	}
+	s := p.leastLoaded()
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return nil, ErrServerClosed
+	}
+	d := &md5Digest{pool: p, priority: opts.Priority.class()}
+	s.register(d)
+	return d, nil
+}
+
+// Close closes all servers in the pool.
+func (p *ServerPool) Close() {
+	p.Shutdown(context.Background())
+}
+
+// Shutdown shuts down all servers in the pool in parallel.
+// The first error is returned.
+func (p *ServerPool) Shutdown(ctx context.Context) error {
+	if p.fallback != nil {
+		return p.fallback.Shutdown(ctx)
+	}
+	errs := make(chan error, len(p.servers))
+	for _, s := range p.servers {
+		go func(s *md5Server) {
+			errs <- s.Shutdown(ctx)
+		}(s)
+	}
+	var err error
+	for range p.servers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Stats returns the combined statistics of all servers in the pool.
+func (p *ServerPool) Stats() Stats {
+	var st Stats
+	for _, s := range p.servers {
+		st.add(s.Stats())
+	}
+	return st
+}
+
+// LiveHashers returns the open hashers of all servers in the pool, oldest first.
+// nil is returned unless ServerOptions.TrackHashers is set.
+func (p *ServerPool) LiveHashers() []HasherInfo {
+	if p.fallback != nil {
+		return p.fallback.LiveHashers()
+	}
+	var infos []HasherInfo
+	for _, s := range p.servers {
+		infos = append(infos, s.LiveHashers()...)
+	}
+	sortHasherInfos(infos)
+	return infos
+}
+
+// Saturated reports whether all servers in the pool are saturated.
+func (p *ServerPool) Saturated() bool {
+	if p.fallback != nil {
+		return p.fallback.Saturated()
+	}
+	for _, s := range p.servers {
+		if !s.Saturated() {
+			return false
+		}
+	}
+	return true
+}
+
+// leastLoaded returns the server with the fewest active hashers.
+func (p *ServerPool) leastLoaded() *md5Server {
+	best, bestN := p.servers[0], atomic.LoadInt64(&p.servers[0].stats.clients)
+	for _, s := range p.servers[1:] {
+		if n := atomic.LoadInt64(&s.stats.clients); n < bestN {
+			best, bestN = s, n
+		}
+	}
+	return best
+}
+
+// rebalance returns the server a hasher on cur should use after a reset.
+// cur is returned unless it is saturated and another server has room.
+func (p *ServerPool) rebalance(cur *md5Server) *md5Server {
+	n := atomic.LoadInt64(&cur.stats.clients)
+	if n <= int64(cur.options.Lanes) {
+		return cur
+	}
+	best := p.leastLoaded()
+	// Moving must leave the new server less loaded than the current one.
+	if atomic.LoadInt64(&best.stats.clients)+1 >= n {
+		return cur
+	}
+	return best
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"bytes"
+	"crypto/md5"
+	"sync/atomic"
+	"testing"
+)
+
+func TestServerPool(t *testing.T) {
+	if _, err := NewServerPool(0, ServerOptions{}); err == nil {
+		t.Error("expected error for empty pool")
+	}
+	for _, backend := range AvailableBackends() {
+		t.Run(backend.String(), func(t *testing.T) {
+			pool, err := NewServerPool(3, ServerOptions{Backend: backend})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pool.Close()
+			testMd5Simulator(t, 40, 3, 200<<10, pool)
+		})
+	}
+}
+
+func TestServerPoolPlacement(t *testing.T) {
+	pool, err := NewServerPool(2, ServerOptions{Backend: BackendGeneric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	clients := func(i int) int64 {
+		return atomic.LoadInt64(&pool.servers[i].stats.clients)
+	}
+
+	hashers := make([]Hasher, 2*(Lanes+1))
+	for i := range hashers {
+		hashers[i] = pool.NewHash()
+	}
+	if clients(0) != Lanes+1 || clients(1) != Lanes+1 {
+		t.Fatalf("hashers not spread evenly: %d, %d", clients(0), clients(1))
+	}
+	if got := pool.Stats().Clients; got != len(hashers) {
+		t.Errorf("got %d clients, want %d", got, len(hashers))
+	}
+
+	// Empty the second server.
+	var first []Hasher
+	for _, h := range hashers {
+		if h.(*md5Digest).server == pool.servers[1] {
+			h.Close()
+		} else {
+			first = append(first, h)
+		}
+	}
+
+	// Resetting a hasher on the saturated server moves it.
+	h := first[0]
+	h.Write([]byte("discarded"))
+	h.Reset()
+	if h.(*md5Digest).server != pool.servers[1] {
+		t.Fatal("hasher was not moved on reset")
+	}
+	if clients(0) != Lanes || clients(1) != 1 {
+		t.Fatalf("unexpected clients after move: %d, %d", clients(0), clients(1))
+	}
+	// Server 0 is no longer saturated.
+	first[1].Reset()
+	if first[1].(*md5Digest).server != pool.servers[0] {
+		t.Fatal("hasher was moved from unsaturated server")
+	}
+
+	input := bytes.Repeat([]byte("moved"), 10000)
+	h.Write(input)
+	want := md5.Sum(input)
+	if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	for _, h := range first {
+		h.Close()
+	}
+	if got := pool.Stats().Clients; got != 0 {
+		t.Errorf("got %d clients after close, want 0", got)
+	}
+}
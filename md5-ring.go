@@ -0,0 +1,314 @@
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ringPerLane is the number of descriptors the submit ring of a server holds per lane.
+const ringPerLane = 16
+
+// sendYields is the number of times a producer yields
+// while the ring is full before it parks.
+const sendYields = 4
+
+// submitRing is a bounded multi-producer, single-consumer queue
+// of block descriptors sent by hashers to the server.
+//
+// Producers claim a cell by advancing head, and publish it by updating
+// the sequence number of the cell. The server is the only consumer,
+// so tail is not shared.
+type submitRing struct {
+	head uint64 // Next position to claim, shared by producers.
+	_    [56]byte
+	tail uint64 // Next position to consume, only used by the server.
+	mask uint64
+
+	cells []ringCell
+
+	// sleeping is set by the server before waiting on notify.
+	// The first producer to clear it sends a wakeup.
+	sleeping int32
+	// closed is set when the server has stopped consuming.
+	closed int32
+	// senders is the number of producers in tryPush.
+	senders int32
+	notify  chan struct{}
+
+	// waiting is set by producers parked on space until the server pops.
+	waiting int32
+	spaceMu sync.Mutex
+	space   chan struct{} // Closed to wake parked producers, then replaced.
+}
+
+type ringCell struct {
+	seq uint64
+	val blockInput
+}
+
+// newSubmitRing returns a ring that holds at least size descriptors.
+func newSubmitRing(size int) *submitRing {
+	n := 64
+	for n < size {
+		n <<= 1
+	}
+	r := &submitRing{
+		mask:   uint64(n - 1),
+		cells:  make([]ringCell, n),
+		notify: make(chan struct{}, 1),
+		space:  make(chan struct{}),
+	}
+	for i := range r.cells {
+		r.cells[i].seq = uint64(i)
+	}
+	return r
+}
+
+// push adds v to the ring.
+// false is returned if the ring is full.
+func (r *submitRing) push(v blockInput) bool {
+	pos := atomic.LoadUint64(&r.head)
+	for {
+		c := &r.cells[pos&r.mask]
+		seq := atomic.LoadUint64(&c.seq)
+		switch dif := int64(seq - pos); {
+		case dif == 0:
+			if atomic.CompareAndSwapUint64(&r.head, pos, pos+1) {
+				c.val = v
+				atomic.StoreUint64(&c.seq, pos+1)
+				return true
+			}
+		case dif < 0:
+			// The server has not consumed the cell yet.
+			return false
+		}
+		pos = atomic.LoadUint64(&r.head)
+	}
+}
+
+// send adds v to the ring, waiting while it is full,
+// and wakes the server if it is waiting.
+// ErrServerClosed is returned if the ring is closed, since nobody will consume v.
+func (r *submitRing) send(v blockInput) error {
+	for i := 0; ; i++ {
+		ok, err := r.tryPush(v)
+		if err != nil {
+			return err
+		}
+		if ok {
+			break
+		}
+		if i < sendYields {
+			runtime.Gosched()
+			continue
+		}
+		r.park(nil)
+	}
+	r.wake()
+	return nil
+}
+
+// sendContext is like send, but gives up when ctx is done.
+// A nil ctx does not wait, and returns ErrWouldBlock if the ring is full.
+func (r *submitRing) sendContext(ctx context.Context, v blockInput) error {
+	for i := 0; ; i++ {
+		ok, err := r.tryPush(v)
+		if err != nil {
+			return err
+		}
+		if ok {
+			break
+		}
+		if ctx == nil {
+			return ErrWouldBlock
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if i < sendYields {
+			runtime.Gosched()
+			continue
+		}
+		r.park(ctx.Done())
+	}
+	r.wake()
+	return nil
+}
+
+// tryPush is like push, but fails with ErrServerClosed if the ring is closed.
+// The server drains the ring until no tryPush is running,
+// so a descriptor that was added is always consumed.
+func (r *submitRing) tryPush(v blockInput) (bool, error) {
+	atomic.AddInt32(&r.senders, 1)
+	defer atomic.AddInt32(&r.senders, -1)
+	if atomic.LoadInt32(&r.closed) != 0 {
+		return false, ErrServerClosed
+	}
+	return r.push(v), nil
+}
+
+// sending reports whether a producer may still add to the ring.
+func (r *submitRing) sending() bool {
+	return atomic.LoadInt32(&r.senders) != 0
+}
+
+// park blocks until the server has popped from the ring,
+// the ring is closed or done is closed.
+// It may return early, so the caller must try again.
+func (r *submitRing) park(done <-chan struct{}) {
+	r.spaceMu.Lock()
+	atomic.StoreInt32(&r.waiting, 1)
+	space := r.space
+	r.spaceMu.Unlock()
+	// The server may have popped before it could see waiting.
+	if !r.full() || atomic.LoadInt32(&r.closed) != 0 {
+		return
+	}
+	select {
+	case <-space:
+	case <-done:
+	}
+}
+
+// unpark wakes all parked producers.
+func (r *submitRing) unpark() {
+	r.spaceMu.Lock()
+	atomic.StoreInt32(&r.waiting, 0)
+	close(r.space)
+	r.space = make(chan struct{})
+	r.spaceMu.Unlock()
+}
+
+// close marks the ring as no longer consumed and wakes parked producers.
+func (r *submitRing) close() {
+	atomic.StoreInt32(&r.closed, 1)
+	r.unpark()
+}
+
+// full reports whether push would fail.
+func (r *submitRing) full() bool {
+	pos := atomic.LoadUint64(&r.head)
+	return int64(atomic.LoadUint64(&r.cells[pos&r.mask].seq)-pos) < 0
+}
+
+// wake signals the server if it is waiting for input.
+func (r *submitRing) wake() {
+	if atomic.LoadInt32(&r.sleeping) != 0 && atomic.CompareAndSwapInt32(&r.sleeping, 1, 0) {
+		select {
+		case r.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pop returns the oldest descriptor in the ring.
+// false is returned if the ring is empty.
+// Only the server may call pop.
+func (r *submitRing) pop() (blockInput, bool) {
+	c := &r.cells[r.tail&r.mask]
+	if atomic.LoadUint64(&c.seq) != r.tail+1 {
+		return blockInput{}, false
+	}
+	v := c.val
+	c.val = blockInput{}
+	atomic.StoreUint64(&c.seq, r.tail+r.mask+1)
+	r.tail++
+	if atomic.LoadInt32(&r.waiting) != 0 {
+		r.unpark()
+	}
+	return v, true
+}
+
+// empty returns whether the ring has nothing to pop.
+func (r *submitRing) empty() bool {
+	return atomic.LoadUint64(&r.cells[r.tail&r.mask].seq) != r.tail+1
+}
+
+// wait blocks until the ring may have input or timeout fires.
+// A nil timeout waits for input only.
+// false is returned on timeout.
+func (r *submitRing) wait(timeout <-chan time.Time) bool {
+	atomic.StoreInt32(&r.sleeping, 1)
+	if !r.empty() {
+		atomic.StoreInt32(&r.sleeping, 0)
+		return true
+	}
+	select {
+	case <-r.notify:
+		return true
+	case <-timeout:
+		atomic.StoreInt32(&r.sleeping, 0)
+		return false
+	}
+}
+
+// blockQueue is a FIFO of descriptors waiting for their client to get a lane.
+type blockQueue struct {
+	items []blockInput
+	head  int
+}
+
+func (q *blockQueue) len() int { return len(q.items) - q.head }
+
+func (q *blockQueue) push(b blockInput) {
+	if q.head > 0 && len(q.items) == cap(q.items) {
+		// Reuse the space of popped items instead of growing.
+		n := copy(q.items, q.items[q.head:])
+		for i := n; i < len(q.items); i++ {
+			q.items[i] = blockInput{}
+		}
+		q.items, q.head = q.items[:n], 0
+	}
+	q.items = append(q.items, b)
+}
+
+func (q *blockQueue) peek() *blockInput { return &q.items[q.head] }
+
+func (q *blockQueue) pop() blockInput {
+	b := q.items[q.head]
+	q.items[q.head] = blockInput{}
+	q.head++
+	if q.head == len(q.items) {
+		q.items, q.head = q.items[:0], 0
+	}
+	return b
+}
+
+// clientQueue is a FIFO of clients with queued blocks.
+type clientQueue struct {
+	items []*client
+	head  int
+}
+
+func (q *clientQueue) len() int { return len(q.items) - q.head }
+
+func (q *clientQueue) push(c *client) {
+	if q.head > 0 && len(q.items) == cap(q.items) {
+		// Reuse the space of popped items instead of growing.
+		n := copy(q.items, q.items[q.head:])
+		for i := n; i < len(q.items); i++ {
+			q.items[i] = nil
+		}
+		q.items, q.head = q.items[:n], 0
+	}
+	q.items = append(q.items, c)
+}
+
+func (q *clientQueue) peek() *client { return q.items[q.head] }
+
+func (q *clientQueue) pop() *client {
+	c := q.items[q.head]
+	q.items[q.head] = nil
+	q.head++
+	if q.head == len(q.items) {
+		q.items, q.head = q.items[:0], 0
+	}
+	return c
+}
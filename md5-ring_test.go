@@ -0,0 +1,79 @@
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fullRing returns a ring without room for another descriptor.
+func fullRing() *submitRing {
+	r := newSubmitRing(0)
+	for r.push(blockInput{}) {
+	}
+	return r
+}
+
+// sendParked starts send on r and returns once it has parked.
+// The returned channel is closed when send returns.
+func sendParked(t *testing.T, r *submitRing) chan struct{} {
+	t.Helper()
+	sent := make(chan struct{})
+	go func() {
+		r.send(blockInput{})
+		close(sent)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&r.waiting) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("send did not park")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-sent:
+		t.Fatal("sent to a full ring")
+	default:
+	}
+	return sent
+}
+
+func waitSent(t *testing.T, sent chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("send was not woken by %s", what)
+	}
+}
+
+func TestSubmitRingPark(t *testing.T) {
+	r := fullRing()
+	sent := sendParked(t, r)
+	if _, ok := r.pop(); !ok {
+		t.Fatal("pop from a full ring failed")
+	}
+	waitSent(t, sent, "pop")
+
+	sent = sendParked(t, r)
+	r.close()
+	waitSent(t, sent, "close")
+	if err := r.send(blockInput{}); err != ErrServerClosed {
+		t.Errorf("got %v sending to a closed ring, want %v", err, ErrServerClosed)
+	}
+
+	r = fullRing()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := r.sendContext(ctx, blockInput{}); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if atomic.LoadInt32(&r.waiting) == 0 {
+		t.Error("sendContext did not park")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"time"
+)
+
+// priorityWeights are the number of lanes each class gets per scheduling cycle
+// when all classes have hashers waiting.
+var priorityWeights = [numPriorities]int{
+	PriorityHigh:   4,
+	PriorityNormal: 2,
+	PriorityLow:    1,
+}
+
+// priorityOrder is the order in which classes are offered lanes.
+var priorityOrder = [numPriorities]Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// starveRounds is the number of rounds after which a waiting client
+// gets the next lane, regardless of its class.
+const starveRounds = 4
+
+// class returns the scheduling class of p.
+func (p Priority) class() Priority {
+	if p >= numPriorities {
+		return PriorityNormal
+	}
+	return p
+}
+
+// readyQueues contains the clients with queued blocks waiting for a lane,
+// in a FIFO per class.
+//
+// Lanes are handed out weighted round robin over the classes with waiting clients.
+// A client that has waited starveRounds rounds is picked first,
+// so low classes make progress under sustained load.
+// It is only accessed by the server goroutine.
+type readyQueues struct {
+	queues  [numPriorities]clientQueue
+	credits [numPriorities]int
+	n       int
+	round   uint64 // Incremented for every processed round.
+}
+
+func (r *readyQueues) len() int { return r.n }
+
+// push adds cl to the queue of its class.
+func (r *readyQueues) push(cl *client) {
+	cl.queued = true
+	cl.queuedRound = r.round
+	cl.queuedAt = time.Now()
+	r.queues[cl.priority].push(cl)
+	r.n++
+}
+
+// pop returns the next client to get a lane.
+// The queue must not be empty.
+func (r *readyQueues) pop(stats *serverStats) *client {
+	c := r.next()
+	cl := r.queues[c].pop()
+	r.n--
+	cl.queued = false
+	stats.addPriorityWait(c, time.Since(cl.queuedAt))
+	return cl
+}
+
+// next returns the class to take a client from.
+func (r *readyQueues) next() Priority {
+	// Take the client that waited longest, if it is starving.
+	starved, oldest := Priority(0), uint64(0)
+	for _, c := range priorityOrder {
+		if q := &r.queues[c]; q.len() > 0 {
+			if waited := r.round - q.peek().queuedRound; waited >= starveRounds && waited > oldest {
+				starved, oldest = c, waited
+			}
+		}
+	}
+	if oldest > 0 {
+		return starved
+	}
+	for {
+		for _, c := range priorityOrder {
+			if r.queues[c].len() > 0 && r.credits[c] > 0 {
+				r.credits[c]--
+				return c
+			}
+		}
+		// All classes with waiting clients used their lanes, start a new cycle.
+		r.credits = priorityWeights
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"bytes"
+	"crypto/md5"
+	"sync"
+	"testing"
+)
+
+func TestReadyQueues(t *testing.T) {
+	var r readyQueues
+	var st serverStats
+	clients := make(map[*client]bool)
+	for p := Priority(0); p < numPriorities; p++ {
+		for i := 0; i < 10; i++ {
+			cl := &client{priority: p}
+			clients[cl] = true
+			r.push(cl)
+		}
+	}
+
+	// Every round takes 7 clients and puts them back, as the server would.
+	var got [numPriorities]int
+	for round := 0; round < 4; round++ {
+		var taken []*client
+		for i := 0; i < 7; i++ {
+			cl := r.pop(&st)
+			got[cl.priority]++
+			taken = append(taken, cl)
+		}
+		for _, cl := range taken {
+			r.push(cl)
+		}
+		r.round++
+	}
+	want := [numPriorities]int{PriorityHigh: 16, PriorityNormal: 8, PriorityLow: 4}
+	if got != want {
+		t.Errorf("got %v lanes per class, want %v", got, want)
+	}
+
+	// Keep high and normal busy, low must still get lanes.
+	var low int
+	for round := 0; round < 40; round++ {
+		var taken []*client
+		for i := 0; i < 4; i++ {
+			cl := r.pop(&st)
+			if cl.priority == PriorityLow {
+				low++
+			}
+			taken = append(taken, cl)
+		}
+		for _, cl := range taken {
+			r.push(cl)
+		}
+		r.round++
+	}
+	if low == 0 {
+		t.Error("low priority clients were starved")
+	}
+	if r.len() != len(clients) {
+		t.Errorf("got %d queued clients, want %d", r.len(), len(clients))
+	}
+	stats := st.load()
+	if stats.PriorityWaits[PriorityHigh] == 0 || stats.PriorityWaits[PriorityLow] == 0 {
+		t.Errorf("waits not counted: %v", stats.PriorityWaits)
+	}
+}
+
+func TestHashPriorities(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric, Lanes: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	input := bytes.Repeat([]byte{0x61}, 300<<10)
+	want := md5.Sum(input)
+	var wg sync.WaitGroup
+	for i := 0; i < 24; i++ {
+		wg.Add(1)
+		go func(p Priority) {
+			defer wg.Done()
+			h := server.(OptionsServer).NewHashWithOptions(HashOptions{Priority: p})
+			defer h.Close()
+			for j := 0; j < 2; j++ {
+				h.Reset()
+				h.Write(input)
+				c := h.(Cloner).Clone()
+				if got := c.Sum(nil); !bytes.Equal(got, want[:]) {
+					t.Errorf("%v clone: got %x, want %x", p, got, want)
+				}
+				c.Close()
+				if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+					t.Errorf("%v: got %x, want %x", p, got, want)
+				}
+			}
+		}(Priority(i % 4)) // Includes an unknown class.
+	}
+	wg.Wait()
+
+	st := server.(StatsServer).Stats()
+	var waits uint64
+	for _, n := range st.PriorityWaits {
+		waits += n
+	}
+	if waits == 0 {
+		t.Error("no lane waits counted")
+	}
+}
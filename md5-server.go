@@ -0,0 +1,805 @@
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operations sent to the server.
+const (
+	opBlock    = iota // Block, sum or reset of a client.
+	opRegister        // Register a new client.
+	opClose           // Client closed.
+	opShutdown        // Server closed.
+)
+
+// Message to send across the submission ring
+type blockInput struct {
+	op    int
+	cl    *client
+	msg   []byte
+	sumCh chan sumResult
+	sum   *SumFuture // Receives the digest of a trailer, like sumCh.
+	reset bool
+	// state, if set on a reset, replaces the interim digest instead of clearing it.
+	state *[4]uint32
+}
+
+// isSum returns whether the block is a trailer to be returned as a sum.
+func (b *blockInput) isSum() bool {
+	return b.sumCh != nil || b.sum != nil
+}
+
+type sumResult struct {
+	digest [Size]byte
+	err    error
+}
+
+type lanesInfo []blockInput
+
+// md5Server - Type to implement parallel handling of MD5 invocations
+type md5Server struct {
+	stats        serverStats // Kept first for 64 bit alignment.
+	options      ServerOptions
+	backend      Backend        // Resolved backend, never BackendAuto or BackendStdlib
+	ring         *submitRing    // Input from all clients.
+	closed       int32          // Set atomically by Shutdown.
+	aborted      int32          // Set atomically when Shutdown gives up waiting.
+	done         chan struct{}  // Closed when the server goroutine has stopped.
+	slots        slotTable      // (Interim) digest results of all clients
+	maskRounds16 [16]maskRounds // Pre-allocated static array for max 16 rounds
+	maskRounds8a [8]maskRounds  // Pre-allocated static array for max 8 rounds (1st AVX2 core)
+	maskRounds8b [8]maskRounds  // Pre-allocated static array for max 8 rounds (2nd AVX2 core)
+	buffers      *bufferPool    // Buffers sent by hashers.
+	tracker      hasherTracker  // Open hashers, if TrackHashers is set.
+
+	i8       [2][8][]byte // avx2 temporary vars
+	d8a, d8b digest8
+	wg       sync.WaitGroup
+	panics   [Lanes]interface{} // Panics of the scalar lanes in the current round.
+}
+
+// NewServer - Create new object for parallel processing handling
+func NewServer() Server {
+	s, err := NewServerWithOptions(ServerOptions{
+		UseAVX512: true,
+	})
+	if err != nil {
+		// Default options are always valid.
+		panic(err)
+	}
+	return s
+}
+
+// NewServerWithOptions creates a server using the supplied options.
+// Zero values in the options are replaced by their defaults.
+// An error is returned if the options are invalid.
+func NewServerWithOptions(opts ServerOptions) (Server, error) {
+	opts, backend, err := resolveOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if backend == BackendStdlib {
+		return &fallbackServer{}, nil
+	}
+	return newServer(opts, backend), nil
+}
+
+// resolveOptions applies defaults to the options and selects the backend.
+func resolveOptions(opts ServerOptions) (ServerOptions, Backend, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return opts, 0, err
+	}
+	backend, err := selectBackend(opts)
+	return opts, backend, err
+}
+
+// newServer creates and starts a server with resolved options.
+func newServer(opts ServerOptions, backend Backend) *md5Server {
+	md5srv := &md5Server{}
+	md5srv.options = opts
+	md5srv.backend = backend
+	nBufs := opts.MemoryBudget / opts.ChunkSize
+	// Producers park while the ring is full, so its size does not depend on the budget.
+	md5srv.ring = newSubmitRing(ringPerLane * opts.Lanes)
+	md5srv.done = make(chan struct{})
+	md5srv.buffers = newBufferPool(opts.ChunkSize, nBufs, opts.IdleRelease, &md5srv.stats)
+
+	// Start a single thread for reading from the submission ring
+	go md5srv.process()
+	return md5srv
+}
+
+// selectBackend returns the backend to use for the options.
+func selectBackend(opts ServerOptions) (Backend, error) {
+	switch opts.Backend {
+	case BackendAuto:
+		switch {
+		case hasAVX512 && opts.UseAVX512:
+			return BackendAVX512, nil
+		case hasAVX2:
+			return BackendAVX2, nil
+		}
+		return BackendStdlib, nil
+	case BackendAVX512, BackendAVX2, BackendScalarAsm, BackendStdlib, BackendGeneric:
+		for _, b := range AvailableBackends() {
+			if b == opts.Backend {
+				return b, nil
+			}
+		}
+	}
+	return 0, &UnsupportedBackendError{Backend: opts.Backend}
+}
+
+// client is the server side state of a registered client.
+// It is created by the hasher, but only accessed by the server goroutine,
+// except for err.
+type client struct {
+	slot    int
+	pending blockQueue // Input not yet handled, in order.
+	inLane  bool       // A block is in a lane of the current round.
+	queued  bool       // The client is on the ready list.
+
+	saved       [4]uint32 // State before the sum in the current round.
+	priority    Priority  // Set on creation.
+	queuedRound uint64    // Round the client was added to the ready list.
+	queuedAt    time.Time // Time the client was added to the ready list.
+
+	// err holds a clientError once the server failed to process the client.
+	err atomic.Value
+}
+
+// clientError wraps the error of a failed client, so it can be stored in an atomic.Value.
+type clientError struct {
+	err error
+}
+
+// failure returns the error the client failed with, or nil.
+func (cl *client) failure() error {
+	if v := cl.err.Load(); v != nil {
+		return v.(clientError).err
+	}
+	return nil
+}
+
+// slotTable holds the interim digests of all clients, indexed by slot.
+// Slots of closed clients are recycled, so the table is bounded by the
+// peak number of concurrent clients.
+// It is only accessed by the server goroutine.
+type slotTable struct {
+	states [][4]uint32
+	free   []int
+}
+
+// alloc returns a free slot, initialized to the initial digest.
+func (t *slotTable) alloc() int {
+	var i int
+	if n := len(t.free); n > 0 {
+		i = t.free[n-1]
+		t.free = t.free[:n-1]
+	} else {
+		i = len(t.states)
+		t.states = append(t.states, [4]uint32{})
+	}
+	t.reset(i)
+	return i
+}
+
+// reset sets slot i to the initial digest.
+func (t *slotTable) reset(i int) {
+	t.states[i] = [4]uint32{init0, init1, init2, init3}
+}
+
+// release returns slot i to the free list.
+func (t *slotTable) release(i int) {
+	t.free = append(t.free, i)
+}
+
+// process - Sole handler for reading from the submission ring.
+func (s *md5Server) process() {
+	// To fill up as many lanes as possible:
+	//
+	// 1. Wait for input on the ring.
+	// 2. Queue input per client. A client not already in a lane gets one,
+	//    otherwise it is added to the ready list when the round is done.
+	// 3. Start timer, if MaxGatherDelay is set.
+	// 4. Check if lanes is full or MinLanes are filled, if so, goto 10 (process).
+	// 5. If timeout, goto 10.
+	// 6. Wait for more input (goto 2) or timeout (goto 10).
+	// 10. Process.
+	// 11. Give lanes to clients on the ready list, weighted by priority.
+	// 12. Goto 1
+
+	// width is the number of lanes per round.
+	width := s.options.Lanes
+	// lanes contains the lanes.
+	lanes := make(lanesInfo, width)
+	// laneClients contains the clients of the filled lanes.
+	laneClients := make([]*client, width)
+	// lanesFilled contains the number of filled lanes for current cycle.
+	var lanesFilled int
+	// clients is the number of active clients.
+	var clients int
+	// ready contains clients with queued blocks, waiting for a lane.
+	var ready readyQueues
+
+	// service handles queued input of cl until a block is added to a lane.
+	// Blocks of failed clients are dropped.
+	// If handling a block panics, the client fails.
+	service := func(cl *client) {
+		defer func() {
+			if r := recover(); r != nil {
+				repanicInvariant(r)
+				err := fmt.Errorf("%w: %v", ErrInternal, r)
+				cl.err.Store(clientError{err: err})
+				for cl.pending.len() > 0 {
+					block := cl.pending.pop()
+					if block.op == opClose {
+						// The slot is still released, so it can be reused.
+						s.control(block)
+						clients--
+						continue
+					}
+					s.failBlock(&block, err)
+				}
+			}
+		}()
+		for cl.pending.len() > 0 {
+			failed := cl.failure()
+			// Blocks are popped once handled, so they are failed if it panics.
+			block := cl.pending.peek()
+			if failed == nil && block.op == opBlock && !block.reset && len(block.msg) > 0 {
+				if lanesFilled == width {
+					if !cl.queued {
+						ready.push(cl)
+					}
+					return
+				}
+				if block.isSum() {
+					// Hashing the trailer must not change the state.
+					cl.saved = s.slots.states[cl.slot]
+				}
+				lanes[lanesFilled] = cl.pending.pop()
+				laneClients[lanesFilled] = cl
+				lanesFilled++
+				cl.inLane = true
+				return
+			}
+			if failed != nil && block.op == opBlock {
+				s.failBlock(block, failed)
+			} else {
+				s.control(*block)
+				if block.op == opClose {
+					clients--
+				}
+			}
+			cl.pending.pop()
+		}
+	}
+
+	// stopping is set once shutdown was requested.
+	// The server then stops when all queued input has been processed.
+	var stopping bool
+
+	// drain moves all input from the ring to the clients.
+	// false is returned when the server must stop without processing queued input.
+	drain := func() bool {
+		if atomic.LoadInt32(&s.aborted) != 0 {
+			return false
+		}
+		for {
+			block, ok := s.ring.pop()
+			if !ok {
+				return true
+			}
+			switch block.op {
+			case opShutdown:
+				stopping = true
+				continue
+			case opRegister:
+				block.cl.slot = s.slots.alloc()
+				clients++
+				atomic.StoreInt64(&s.stats.slots, int64(len(s.slots.states)-len(s.slots.free)))
+				continue
+			}
+			cl := block.cl
+			cl.pending.push(block)
+			if !cl.inLane && !cl.queued {
+				service(cl)
+			}
+		}
+	}
+
+	// fill gives lanes to clients on the ready list.
+	fill := func() {
+		for lanesFilled < width && ready.len() > 0 {
+			service(ready.pop(&s.stats))
+		}
+	}
+
+	allLanesFilled := func() bool {
+		return lanesFilled == width || lanesFilled >= clients
+	}
+
+	// gatherTimer limits the time spent waiting for lanes.
+	gatherTimer := time.NewTimer(time.Hour)
+	gatherTimer.Stop()
+	defer gatherTimer.Stop()
+
+	defer func() {
+		// Fail everything still queued, so no hasher waits for a stopped server.
+		err := ErrServerClosed
+		if r := recover(); r != nil {
+			repanicInvariant(r)
+			// The state of the server cannot be trusted, so stop it.
+			atomic.StoreInt32(&s.closed, 1)
+			err = fmt.Errorf("%w: %v", ErrInternal, r)
+		}
+		s.ring.close()
+		for i := range lanes[:lanesFilled] {
+			s.failBlock(&lanes[i], err)
+		}
+		for _, cl := range laneClients[:lanesFilled] {
+			s.failPending(cl, err)
+		}
+		for ready.len() > 0 {
+			s.failPending(ready.pop(&s.stats), err)
+		}
+		for {
+			// Producers that got past the closed check may still add to the ring.
+			idle := !s.ring.sending()
+			block, ok := s.ring.pop()
+			if ok {
+				s.failBlock(&block, err)
+				continue
+			}
+			if idle {
+				break
+			}
+			runtime.Gosched()
+		}
+		if debugChecks && atomic.LoadInt64(&s.stats.clients) == 0 {
+			// Without hashers nobody can hold a buffer.
+			s.buffers.debugLeaks()
+		}
+		s.buffers.release()
+		close(s.done)
+	}()
+
+	for {
+		// Step 1.
+		fill()
+		for lanesFilled == 0 {
+			if !drain() {
+				return
+			}
+			if lanesFilled == 0 {
+				if stopping {
+					// Everything queued has been processed.
+					return
+				}
+				s.ring.wait(nil)
+			}
+		}
+
+		if !allLanesFilled() {
+			if !drain() {
+				return
+			}
+		}
+
+		// If we did not fill all lanes, check if there is more waiting
+		if !allLanesFilled() {
+			runtime.Gosched()
+			if !drain() {
+				return
+			}
+		}
+		// Wait for more lanes, bounded by the gather delay.
+		if s.options.MaxGatherDelay > 0 && !allLanesFilled() && lanesFilled < s.options.MinLanes {
+			start := time.Now()
+			timedOut := false
+			gatherTimer.Reset(s.options.MaxGatherDelay)
+			for !allLanesFilled() && lanesFilled < s.options.MinLanes {
+				if !s.ring.wait(gatherTimer.C) {
+					timedOut = true
+					break
+				}
+				if !drain() {
+					return
+				}
+			}
+			if !timedOut && !gatherTimer.Stop() {
+				<-gatherTimer.C
+			}
+			s.stats.addGather(time.Since(start), timedOut)
+		}
+		if false {
+			if !allLanesFilled() {
+				fmt.Println("Not all lanes filled", lanesFilled, "of", clients)
+				//pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
+			} else if true {
+				fmt.Println("all lanes filled")
+			}
+		}
+		// Process the lanes we could collect
+		s.safeBlocks(lanes[:lanesFilled])
+
+		// Clear lanes...
+		for i, cl := range laneClients[:lanesFilled] {
+			cl.inLane = false
+			if cl.pending.len() > 0 && !cl.queued {
+				ready.push(cl)
+			}
+			laneClients[i] = nil
+		}
+		lanesFilled = 0
+		ready.round++
+	}
+}
+
+// control handles a block that does not need a lane.
+func (s *md5Server) control(block blockInput) {
+	cl := block.cl
+	switch {
+	case block.op == opClose:
+		s.slots.release(cl.slot)
+		atomic.StoreInt64(&s.stats.slots, int64(len(s.slots.states)-len(s.slots.free)))
+
+	// If reset message, reset and we're done
+	case block.reset:
+		if block.state != nil {
+			s.slots.states[cl.slot] = *block.state
+		} else {
+			s.slots.reset(cl.slot)
+		}
+
+	// Sums without a trailer return the interim digest.
+	// Trailers are hashed in lanes, see laneDone.
+	case block.isSum():
+		s.deliverSum(&block, &s.slots.states[cl.slot])
+		if block.msg != nil {
+			s.buffers.put(block.msg)
+		}
+	}
+}
+
+// failBlock drops block, sending err to a waiting sum.
+func (s *md5Server) failBlock(block *blockInput, err error) {
+	switch {
+	case block.sumCh != nil:
+		select {
+		case block.sumCh <- sumResult{err: err}:
+		default:
+			// Already answered before a panic.
+		}
+	case block.sum != nil:
+		block.sum.err = err
+		close(block.sum.done)
+	}
+	if block.msg != nil {
+		s.buffers.put(block.msg)
+	}
+	*block = blockInput{}
+}
+
+// failPending drops all queued blocks of cl.
+func (s *md5Server) failPending(cl *client, err error) {
+	for cl.pending.len() > 0 {
+		block := cl.pending.pop()
+		s.failBlock(&block, err)
+	}
+}
+
+// failLane fails the client of a lane, after processing it panicked with r.
+// The remaining blocks of the client are dropped when it is serviced.
+func (s *md5Server) failLane(lane *blockInput, r interface{}) {
+	repanicInvariant(r)
+	err := fmt.Errorf("%w: %v", ErrInternal, r)
+	lane.cl.err.Store(clientError{err: err})
+	s.failBlock(lane, err)
+}
+
+// safeBlocks processes the lanes like blocks, but recovers from panics.
+// Lanes that were not completed are then retried one by one,
+// so only clients whose blocks cannot be processed fail.
+func (s *md5Server) safeBlocks(lanes []blockInput) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		repanicInvariant(r)
+		for i := range lanes {
+			if lanes[i].cl == nil {
+				// Completed before the panic.
+				continue
+			}
+			if len(lanes) == 1 {
+				s.failLane(&lanes[i], r)
+				continue
+			}
+			s.safeBlocks(lanes[i : i+1])
+		}
+	}()
+	s.blocks(lanes)
+}
+
+// laneDone completes a processed lane.
+// For sums the digest is delivered and the state before the trailer restored.
+func (s *md5Server) laneDone(lane *blockInput) {
+	if lane.isSum() {
+		state := &s.slots.states[lane.cl.slot]
+		s.deliverSum(lane, state)
+		*state = lane.cl.saved
+	}
+	if lane.msg != nil {
+		s.buffers.put(lane.msg)
+	}
+	*lane = blockInput{}
+}
+
+// deliverSum sends state as the digest requested by block.
+func (s *md5Server) deliverSum(block *blockInput, state *[4]uint32) {
+	var sum sumResult
+	binary.LittleEndian.PutUint32(sum.digest[0:], state[0])
+	binary.LittleEndian.PutUint32(sum.digest[4:], state[1])
+	binary.LittleEndian.PutUint32(sum.digest[8:], state[2])
+	binary.LittleEndian.PutUint32(sum.digest[12:], state[3])
+	if block.sumCh != nil {
+		block.sumCh <- sum
+	} else {
+		block.sum.digest = sum.digest
+		close(block.sum.done)
+	}
+}
+
+// Stats returns the current statistics of the server.
+func (s *md5Server) Stats() Stats {
+	return s.stats.load()
+}
+
+// Saturated reports whether writes currently have to wait for buffers or queue space.
+func (s *md5Server) Saturated() bool {
+	return s.buffers.exhausted() || s.ring.full()
+}
+
+// Close shuts down the server, waiting for all queued blocks to be processed.
+func (s *md5Server) Close() {
+	s.Shutdown(context.Background())
+}
+
+// Shutdown stops the server once all queued blocks have been processed.
+// New hashers are rejected, and hashers that are still open
+// fail with ErrServerClosed when they are used afterwards.
+// If ctx is done first, the remaining blocks are dropped, sums waiting
+// for them fail with ErrServerClosed and ctx.Err() is returned.
+// Shutdown returns after the server goroutine has exited and released its buffers.
+func (s *md5Server) Shutdown(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		if s.buffers.timer != nil {
+			s.buffers.timer.Stop()
+		}
+		// The ring is only closed if the server stopped already.
+		if err := s.ring.sendContext(ctx, blockInput{op: opShutdown}); err != nil && err != ErrServerClosed {
+			// The ring stayed full until ctx was done, so drop what is queued.
+			atomic.StoreInt32(&s.aborted, 1)
+			s.ring.wake()
+			<-s.done
+			return err
+		}
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		atomic.StoreInt32(&s.aborted, 1)
+		<-s.done
+		return ctx.Err()
+	}
+}
+
+// Invoke assembly and send results back
+func (s *md5Server) blocks(lanes []blockInput) {
+	atomic.AddUint64(&s.stats.lanesFilled[len(lanes)], 1)
+	if debugChecks {
+		s.checkLanes(lanes)
+	}
+	states := s.slots.states
+	// The portable backend handles all rounds, so it can be used as a reference.
+	useScalar := len(lanes) < s.options.ScalarBelow && s.backend != BackendGeneric
+	if useScalar || s.backend == BackendScalarAsm {
+		// Use scalar routine when below this many lanes
+		switch len(lanes) {
+		case 0:
+		case 1:
+			lane := lanes[0]
+			if len(lane.msg) > 0 {
+				// Update...
+				blockScalar(&states[lane.cl.slot], lane.msg)
+			}
+			s.stats.addScalarRound(roundScalarSingle, lanes)
+			s.laneDone(&lanes[0])
+
+		default:
+			s.wg.Add(len(lanes))
+			for i := range lanes {
+				lane := lanes[i]
+				go func(i int) {
+					defer s.wg.Done()
+					defer func() {
+						// Panics cannot be recovered by the server goroutine.
+						s.panics[i] = recover()
+					}()
+					if len(lane.msg) == 0 {
+						return
+					}
+					// Update... Slots are distinct, so lanes do not share state.
+					blockScalar(&states[lane.cl.slot], lane.msg)
+				}(i)
+			}
+			s.wg.Wait()
+			s.stats.addScalarRound(roundScalarMulti, lanes)
+			for i := range lanes {
+				if r := s.panics[i]; r != nil {
+					s.panics[i] = nil
+					s.failLane(&lanes[i], r)
+					continue
+				}
+				s.laneDone(&lanes[i])
+			}
+		}
+		return
+	}
+
+	inputs := [16][]byte{}
+	for i := range lanes {
+		inputs[i] = lanes[i].msg
+	}
+
+	// Collect active digests...
+	state := s.getDigests(lanes)
+	var before digest16
+	if debugChecks {
+		before = state
+	}
+	// Process all lanes...
+	// With 8 lanes or less AVX2 uses a single block8 on this goroutine.
+	s.blockMd5_x16(&state, inputs, len(lanes) <= 8)
+	if debugChecks {
+		s.verifyRound(lanes, &before, &state)
+	}
+
+	for i := range lanes {
+		states[lanes[i].cl.slot] = [4]uint32{state.v0[i], state.v1[i], state.v2[i], state.v3[i]}
+		s.laneDone(&lanes[i])
+	}
+}
+
+func (s *md5Server) getDigests(lanes []blockInput) (d digest16) {
+	for i, lane := range lanes {
+		a := &s.slots.states[lane.cl.slot]
+		d.v0[i], d.v1[i], d.v2[i], d.v3[i] = a[0], a[1], a[2], a[3]
+	}
+	return
+}
+
+// Round kinds counted by serverStats.
+const (
+	roundAVX512 = iota
+	roundAVX2Half
+	roundAVX2Full
+	roundScalarSingle
+	roundScalarMulti
+	roundGeneric
+	roundKinds
+)
+
+// serverStats contains the counters behind StatsServer.Stats.
+// All fields are updated atomically.
+type serverStats struct {
+	rounds         [roundKinds]uint64
+	lanesFilled    [Lanes + 1]uint64
+	activeBlocks   uint64
+	maskedBlocks   uint64
+	bufferWaits    uint64
+	bufferWaitNS   uint64
+	gathers        uint64
+	gatherTOs      uint64
+	gatherNS       uint64
+	prioWaits      [numPriorities]uint64
+	prioWaitNS     [numPriorities]uint64
+	clients        int64
+	slots          int64
+	bufferBytes    int64
+	bufferReleases uint64
+}
+
+// addRound counts a SIMD round of the given kind, processed with the mask rounds in mr.
+func (st *serverStats) addRound(kind int, mr []maskRounds, lanes int) {
+	atomic.AddUint64(&st.rounds[kind], 1)
+	st.addBlocks(mr, lanes)
+}
+
+// addBlocks counts the active and masked blocks for the mask rounds in mr.
+func (st *serverStats) addBlocks(mr []maskRounds, lanes int) {
+	var active, masked uint64
+	for _, m := range mr {
+		n := uint64(bits.OnesCount64(m.mask))
+		active += n * m.rounds
+		masked += (uint64(lanes) - n) * m.rounds
+	}
+	atomic.AddUint64(&st.activeBlocks, active)
+	atomic.AddUint64(&st.maskedBlocks, masked)
+}
+
+// addScalarRound counts a scalar round of the given kind.
+func (st *serverStats) addScalarRound(kind int, lanes []blockInput) {
+	atomic.AddUint64(&st.rounds[kind], 1)
+	var active uint64
+	for _, lane := range lanes {
+		active += uint64(len(lane.msg) / BlockSize)
+	}
+	atomic.AddUint64(&st.activeBlocks, active)
+}
+
+// addGather counts a wait for lanes to be filled.
+func (st *serverStats) addGather(d time.Duration, timedOut bool) {
+	atomic.AddUint64(&st.gathers, 1)
+	atomic.AddUint64(&st.gatherNS, uint64(d))
+	if timedOut {
+		atomic.AddUint64(&st.gatherTOs, 1)
+	}
+}
+
+// addPriorityWait counts a wait for a lane by a hasher of class c.
+func (st *serverStats) addPriorityWait(c Priority, d time.Duration) {
+	atomic.AddUint64(&st.prioWaits[c], 1)
+	atomic.AddUint64(&st.prioWaitNS[c], uint64(d))
+}
+
+// addBufferWait counts a wait for a free buffer.
+func (st *serverStats) addBufferWait(d time.Duration) {
+	atomic.AddUint64(&st.bufferWaits, 1)
+	atomic.AddUint64(&st.bufferWaitNS, uint64(d))
+}
+
+func (st *serverStats) load() Stats {
+	var res Stats
+	res.RoundsAVX512 = atomic.LoadUint64(&st.rounds[roundAVX512])
+	res.RoundsAVX2Half = atomic.LoadUint64(&st.rounds[roundAVX2Half])
+	res.RoundsAVX2Full = atomic.LoadUint64(&st.rounds[roundAVX2Full])
+	res.RoundsScalarSingle = atomic.LoadUint64(&st.rounds[roundScalarSingle])
+	res.RoundsScalarMulti = atomic.LoadUint64(&st.rounds[roundScalarMulti])
+	res.RoundsGeneric = atomic.LoadUint64(&st.rounds[roundGeneric])
+	for i := range st.lanesFilled {
+		res.LanesFilled[i] = atomic.LoadUint64(&st.lanesFilled[i])
+	}
+	res.ActiveBlocks = atomic.LoadUint64(&st.activeBlocks)
+	res.MaskedBlocks = atomic.LoadUint64(&st.maskedBlocks)
+	res.BufferWaits = atomic.LoadUint64(&st.bufferWaits)
+	res.BufferWaitTime = time.Duration(atomic.LoadUint64(&st.bufferWaitNS))
+	res.GatherWaits = atomic.LoadUint64(&st.gathers)
+	res.GatherTimeouts = atomic.LoadUint64(&st.gatherTOs)
+	res.GatherTime = time.Duration(atomic.LoadUint64(&st.gatherNS))
+	for i := range st.prioWaits {
+		res.PriorityWaits[i] = atomic.LoadUint64(&st.prioWaits[i])
+		res.PriorityWaitTime[i] = time.Duration(atomic.LoadUint64(&st.prioWaitNS[i]))
+	}
+	res.Clients = int(atomic.LoadInt64(&st.clients))
+	res.StateSlots = int(atomic.LoadInt64(&st.slots))
+	res.BufferBytes = int(atomic.LoadInt64(&st.bufferBytes))
+	res.BufferReleases = atomic.LoadUint64(&st.bufferReleases)
+	return res
+}
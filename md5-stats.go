@@ -0,0 +1,175 @@
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Stats contains statistics about a Server.
+// Servers using BackendStdlib report no statistics.
+type Stats struct {
+	// Number of processing rounds per backend.
+	RoundsAVX512       uint64 // 16 lanes on AVX512.
+	RoundsAVX2Half     uint64 // Up to 8 lanes on a single AVX2 core.
+	RoundsAVX2Full     uint64 // Up to 16 lanes on two AVX2 cores.
+	RoundsScalarSingle uint64 // A single lane on the server goroutine.
+	RoundsScalarMulti  uint64 // Multiple lanes with one goroutine per lane.
+	RoundsGeneric      uint64 // 16 lanes using portable code.
+
+	// LanesFilled is a histogram of the number of lanes filled per round.
+	LanesFilled [16 + 1]uint64
+
+	// Number of 64 byte blocks hashed, and blocks masked out in SIMD rounds.
+	ActiveBlocks uint64
+	MaskedBlocks uint64
+
+	// Number of times a hasher had to wait for a free buffer and the total time spent waiting.
+	BufferWaits    uint64
+	BufferWaitTime time.Duration
+
+	// Number of rounds that waited for more lanes to be filled, how many of these
+	// reached MaxGatherDelay and the total time spent waiting.
+	// Compare with LanesFilled to see the effect of ServerOptions.MaxGatherDelay.
+	GatherWaits    uint64
+	GatherTimeouts uint64
+	GatherTime     time.Duration
+
+	// Number of times a hasher waited for a lane while all lanes were taken,
+	// and the total time spent waiting, indexed by Priority.
+	PriorityWaits    [3]uint64
+	PriorityWaitTime [3]time.Duration
+
+	// Clients is the number of registered hashers.
+	Clients int
+	// StateSlots is the number of digest states held by the server.
+	// It trails Clients, since slots are recycled when the server
+	// notices that a hasher was closed.
+	StateSlots int
+
+	// BufferBytes is the size of the buffers handed out from the arena.
+	// It grows as hashers need more buffers, up to MemoryBudget.
+	BufferBytes int
+	// BufferReleases is the number of times idle buffers were freed.
+	BufferReleases uint64
+}
+
+// PublishExpvar publishes the statistics of s as an expvar variable with the given name.
+// Like expvar.Publish it panics if the name is already in use.
+func PublishExpvar(name string, s StatsServer) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return s.Stats()
+	}))
+}
+
+// StatsHandler returns a http.Handler that serves the statistics of s
+// in the Prometheus text exposition format.
+func StatsHandler(s StatsServer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.Stats().WritePrometheus(w)
+	})
+}
+
+// WritePrometheus writes the statistics in the Prometheus text exposition format.
+func (st Stats) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP md5simd_%s %s\n# TYPE md5simd_%s %s\n", name, help, name, typ)
+	}
+
+	metric("rounds_total", "counter", "Number of processing rounds per backend.")
+	for _, r := range []struct {
+		kind string
+		n    uint64
+	}{
+		{"avx512", st.RoundsAVX512},
+		{"avx2_half", st.RoundsAVX2Half},
+		{"avx2_full", st.RoundsAVX2Full},
+		{"scalar_single", st.RoundsScalarSingle},
+		{"scalar_multi", st.RoundsScalarMulti},
+		{"generic", st.RoundsGeneric},
+	} {
+		fmt.Fprintf(bw, "md5simd_rounds_total{backend=%q} %d\n", r.kind, r.n)
+	}
+
+	metric("lanes_filled", "histogram", "Number of lanes filled per round.")
+	var count, sum uint64
+	for lanes, n := range st.LanesFilled {
+		count += n
+		sum += uint64(lanes) * n
+		fmt.Fprintf(bw, "md5simd_lanes_filled_bucket{le=\"%d\"} %d\n", lanes, count)
+	}
+	fmt.Fprintf(bw, "md5simd_lanes_filled_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(bw, "md5simd_lanes_filled_sum %d\nmd5simd_lanes_filled_count %d\n", sum, count)
+
+	metric("blocks_total", "counter", "Number of 64 byte blocks processed in active and masked lanes.")
+	fmt.Fprintf(bw, "md5simd_blocks_total{lane=\"active\"} %d\n", st.ActiveBlocks)
+	fmt.Fprintf(bw, "md5simd_blocks_total{lane=\"masked\"} %d\n", st.MaskedBlocks)
+
+	metric("buffer_waits_total", "counter", "Number of times a hasher waited for a free buffer.")
+	fmt.Fprintf(bw, "md5simd_buffer_waits_total %d\n", st.BufferWaits)
+	metric("buffer_wait_seconds_total", "counter", "Total time hashers waited for a free buffer.")
+	fmt.Fprintf(bw, "md5simd_buffer_wait_seconds_total %g\n", st.BufferWaitTime.Seconds())
+
+	metric("gather_waits_total", "counter", "Number of rounds that waited for more lanes to be filled.")
+	fmt.Fprintf(bw, "md5simd_gather_waits_total %d\n", st.GatherWaits)
+	metric("gather_timeouts_total", "counter", "Number of rounds where waiting for lanes reached the maximum delay.")
+	fmt.Fprintf(bw, "md5simd_gather_timeouts_total %d\n", st.GatherTimeouts)
+	metric("gather_wait_seconds_total", "counter", "Total time spent waiting for lanes to be filled.")
+	fmt.Fprintf(bw, "md5simd_gather_wait_seconds_total %g\n", st.GatherTime.Seconds())
+
+	metric("lane_waits_total", "counter", "Number of times a hasher waited for a lane, by priority.")
+	for p, n := range st.PriorityWaits {
+		fmt.Fprintf(bw, "md5simd_lane_waits_total{priority=%q} %d\n", Priority(p), n)
+	}
+	metric("lane_wait_seconds_total", "counter", "Total time hashers waited for a lane, by priority.")
+	for p, d := range st.PriorityWaitTime {
+		fmt.Fprintf(bw, "md5simd_lane_wait_seconds_total{priority=%q} %g\n", Priority(p), d.Seconds())
+	}
+
+	metric("clients", "gauge", "Number of registered hashers.")
+	fmt.Fprintf(bw, "md5simd_clients %d\n", st.Clients)
+	metric("state_slots", "gauge", "Number of digest states held by the server.")
+	fmt.Fprintf(bw, "md5simd_state_slots %d\n", st.StateSlots)
+	metric("buffer_bytes", "gauge", "Size of the buffers handed out from the arena.")
+	fmt.Fprintf(bw, "md5simd_buffer_bytes %d\n", st.BufferBytes)
+	metric("buffer_releases_total", "counter", "Number of times idle buffers were freed.")
+	fmt.Fprintf(bw, "md5simd_buffer_releases_total %d\n", st.BufferReleases)
+	return bw.Flush()
+}
+
+// add adds the statistics in o to st.
+func (st *Stats) add(o Stats) {
+	st.RoundsAVX512 += o.RoundsAVX512
+	st.RoundsAVX2Half += o.RoundsAVX2Half
+	st.RoundsAVX2Full += o.RoundsAVX2Full
+	st.RoundsScalarSingle += o.RoundsScalarSingle
+	st.RoundsScalarMulti += o.RoundsScalarMulti
+	st.RoundsGeneric += o.RoundsGeneric
+	for i, n := range o.LanesFilled {
+		st.LanesFilled[i] += n
+	}
+	st.ActiveBlocks += o.ActiveBlocks
+	st.MaskedBlocks += o.MaskedBlocks
+	st.BufferWaits += o.BufferWaits
+	st.BufferWaitTime += o.BufferWaitTime
+	st.GatherWaits += o.GatherWaits
+	st.GatherTimeouts += o.GatherTimeouts
+	st.GatherTime += o.GatherTime
+	for i := range o.PriorityWaits {
+		st.PriorityWaits[i] += o.PriorityWaits[i]
+		st.PriorityWaitTime[i] += o.PriorityWaitTime[i]
+	}
+	st.Clients += o.Clients
+	st.StateSlots += o.StateSlots
+	st.BufferBytes += o.BufferBytes
+	st.BufferReleases += o.BufferReleases
+}
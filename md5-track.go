@@ -0,0 +1,154 @@
+// Copyright (c) 2020 MinIO Inc. All rights reserved.
+// Use of this source code is governed by a license that can be
+// found in the LICENSE file.
+
+package md5simd
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HasherInfo describes a hasher that has not been closed.
+// It is only available if ServerOptions.TrackHashers is set.
+type HasherInfo struct {
+	Created      time.Time     // Time the hasher was created.
+	Age          time.Duration // Time since the hasher was created.
+	BytesWritten uint64        // Bytes written since the hasher was created, including before resets.
+	LastActive   time.Time     // Time the hasher was last used.
+	Stack        string        // Stack of the goroutine that created the hasher.
+}
+
+// hasherRecord is the tracking state of a hasher.
+// It does not reference the hasher, so leaked hashers can be collected.
+type hasherRecord struct {
+	written uint64 // Updated atomically, kept first for 64 bit alignment.
+	last    int64  // Unix nanoseconds of the last use, updated atomically.
+	created time.Time
+	pcs     []uintptr // Callers of the goroutine that created the hasher.
+}
+
+// newHasherRecord returns a record for a hasher registered by the caller of track.
+func newHasherRecord() *hasherRecord {
+	now := time.Now()
+	r := &hasherRecord{created: now, last: now.UnixNano()}
+	pcs := make([]uintptr, 32)
+	// Skip runtime.Callers, newHasherRecord, track and register.
+	r.pcs = pcs[:runtime.Callers(4, pcs)]
+	return r
+}
+
+// touch records the use of the hasher.
+func (r *hasherRecord) touch() {
+	atomic.StoreInt64(&r.last, time.Now().UnixNano())
+}
+
+// info returns the current state of the record.
+func (r *hasherRecord) info() HasherInfo {
+	var stack strings.Builder
+	frames := runtime.CallersFrames(r.pcs)
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(&stack, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+		if !more {
+			break
+		}
+	}
+	return HasherInfo{
+		Created:      r.created,
+		Age:          time.Since(r.created),
+		BytesWritten: atomic.LoadUint64(&r.written),
+		LastActive:   time.Unix(0, atomic.LoadInt64(&r.last)),
+		Stack:        stack.String(),
+	}
+}
+
+// hasherTracker contains the records of the open hashers of a server.
+type hasherTracker struct {
+	mu      sync.Mutex
+	records map[*hasherRecord]struct{}
+}
+
+func (t *hasherTracker) add(r *hasherRecord) {
+	t.mu.Lock()
+	if t.records == nil {
+		t.records = make(map[*hasherRecord]struct{})
+	}
+	t.records[r] = struct{}{}
+	t.mu.Unlock()
+}
+
+func (t *hasherTracker) remove(r *hasherRecord) {
+	t.mu.Lock()
+	delete(t.records, r)
+	t.mu.Unlock()
+}
+
+// list appends the info of all tracked hashers to infos.
+func (t *hasherTracker) list(infos []HasherInfo) []HasherInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for r := range t.records {
+		infos = append(infos, r.info())
+	}
+	return infos
+}
+
+// sortHasherInfos sorts infos by creation time.
+func sortHasherInfos(infos []HasherInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Created.Before(infos[j].Created)
+	})
+}
+
+// LiveHashers returns the hashers of the server that have not been closed,
+// oldest first. nil is returned unless ServerOptions.TrackHashers is set.
+func (s *md5Server) LiveHashers() []HasherInfo {
+	if !s.options.TrackHashers {
+		return nil
+	}
+	infos := s.tracker.list(nil)
+	sortHasherInfos(infos)
+	return infos
+}
+
+// track starts tracking d, if the server tracks hashers.
+func (s *md5Server) track(d *md5Digest) {
+	if !s.options.TrackHashers {
+		return
+	}
+	if d.rec == nil {
+		d.rec = newHasherRecord()
+		runtime.SetFinalizer(d, (*md5Digest).leaked)
+	}
+	s.tracker.add(d.rec)
+}
+
+// advance adds n written bytes to the length of the hash.
+func (d *md5Digest) advance(n int) {
+	d.len += uint64(n)
+	if d.rec != nil {
+		atomic.AddUint64(&d.rec.written, uint64(n))
+	}
+}
+
+// leaked is the finalizer of tracked hashers.
+// Hashers that were not closed are reported and closed.
+func (d *md5Digest) leaked() {
+	if d.cl == nil {
+		return
+	}
+	info := d.rec.info()
+	d.Close()
+	if h := d.server.options.LeakHandler; h != nil {
+		h(info)
+	} else {
+		log.Printf("md5simd: hasher was not closed, %d bytes written, created by:\n%s", info.BytesWritten, info.Stack)
+	}
+}
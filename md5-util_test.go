@@ -1,5 +1,3 @@
-//+build !noasm,!appengine,gc
-
 // Copyright (c) 2020 MinIO Inc. All rights reserved.
 // Use of this source code is governed by a license that can be
 // found in the LICENSE file.
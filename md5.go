@@ -1,9 +1,16 @@
 package md5simd
 
 import (
+	"context"
 	"crypto/md5"
+	"encoding"
+	"errors"
+	"fmt"
 	"hash"
+	"math"
+	"net"
 	"sync"
+	"time"
 )
 
 const (
@@ -13,17 +20,296 @@ const (
 	// The size of an MD5 checksum in bytes.
 	Size = 16
 
+	// Lanes is the number of concurrently calculated hashes.
+	Lanes = 16
+
 	// internalBlockSize is the internal block size.
 	internalBlockSize = 32 << 10
+
+	// buffersPerLane is the default number of buffers per lane.
+	buffersPerLane = 3
+
+	// Use scalar routine when below this many lanes
+	useScalarBelow = 3
+
+	// MD5 initialization constants
+	init0 = 0x67452301
+	init1 = 0xefcdab89
+	init2 = 0x98badcfe
+	init3 = 0x10325476
+
+	// magic and marshaledSize describe the state format used by crypto/md5,
+	// so state can be moved between a Hasher and the stdlib.
+	magic         = "md5\x01"
+	marshaledSize = len(magic) + 4*4 + BlockSize + 8
+)
+
+// Backend identifies the implementation used for hashing blocks.
+type Backend uint8
+
+const (
+	// BackendAuto selects the fastest backend available.
+	BackendAuto Backend = iota
+
+	// BackendAVX512 processes 16 lanes in parallel using AVX512.
+	BackendAVX512
+
+	// BackendAVX2 processes 8 lanes in parallel using AVX2.
+	BackendAVX2
+
+	// BackendScalarAsm processes one lane at the time using scalar assembly.
+	BackendScalarAsm
+
+	// BackendStdlib uses crypto/md5.
+	BackendStdlib
+
+	// BackendGeneric processes 16 lanes in lock-step using portable Go code.
+	// It is much slower than the other backends, but runs the server on all platforms.
+	// It is never selected by BackendAuto.
+	BackendGeneric
 )
 
+// String returns the name of the backend.
+func (b Backend) String() string {
+	switch b {
+	case BackendAuto:
+		return "auto"
+	case BackendAVX512:
+		return "avx512"
+	case BackendAVX2:
+		return "avx2"
+	case BackendScalarAsm:
+		return "scalar"
+	case BackendStdlib:
+		return "stdlib"
+	case BackendGeneric:
+		return "generic"
+	}
+	return "unknown"
+}
+
+// UnsupportedBackendError is returned when a backend is requested
+// that is not available on the current CPU or platform.
+type UnsupportedBackendError struct {
+	Backend Backend
+}
+
+func (e *UnsupportedBackendError) Error() string {
+	return fmt.Sprintf("md5simd: backend %v (%d) is not supported", e.Backend, e.Backend)
+}
+
+// Priority is the scheduling class of a hasher.
+// When more hashers have blocks queued than there are lanes,
+// higher classes get more lanes per round.
+type Priority uint8
+
+const (
+	// PriorityNormal is the default class.
+	PriorityNormal Priority = iota
+
+	// PriorityHigh is meant for latency sensitive hashing.
+	PriorityHigh
+
+	// PriorityLow is meant for background hashing.
+	PriorityLow
+
+	numPriorities = 3
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	}
+	return "unknown"
+}
+
+// HashOptions contains options for a single hasher.
+type HashOptions struct {
+	// Priority is the scheduling class of the hasher.
+	// Default is PriorityNormal.
+	Priority Priority
+}
+
 type Server interface {
 	NewHash() Hasher
 	Close()
 }
 
+// OptionsServer is implemented by servers that support HashOptions.
+type OptionsServer interface {
+	// NewHashWithOptions returns a hasher using the supplied options.
+	// Unknown priorities are treated as PriorityNormal.
+	NewHashWithOptions(opts HashOptions) Hasher
+}
+
+// StatsServer is implemented by servers that report statistics.
+type StatsServer interface {
+	// Stats returns the current statistics of the server.
+	Stats() Stats
+}
+
+// SaturatedServer is implemented by servers that report backpressure.
+type SaturatedServer interface {
+	// Saturated reports whether writes to the server currently have to wait
+	// for buffers or queue space. TryWrite returns ErrWouldBlock in that case.
+	Saturated() bool
+}
+
+// ErrServer is implemented by servers that report errors instead of
+// returning hashers that cannot be used.
+type ErrServer interface {
+	// NewHashErr is like NewHashWithOptions, but returns ErrServerClosed
+	// if the server is closed.
+	NewHashErr(opts HashOptions) (Hasher, error)
+}
+
+// ShutdownServer is implemented by servers that can drain their input before closing.
+type ShutdownServer interface {
+	// Shutdown closes the server after processing all queued input.
+	// If ctx is done first, the remaining input is dropped and ctx.Err() is returned.
+	// Close is Shutdown without a deadline.
+	Shutdown(ctx context.Context) error
+}
+
+// TrackingServer is implemented by servers that can list their open hashers.
+type TrackingServer interface {
+	// LiveHashers returns the hashers that have not been closed, oldest first.
+	// nil is returned unless ServerOptions.TrackHashers is set.
+	LiveHashers() []HasherInfo
+}
+
 type ServerOptions struct {
+	// UseAVX512 allows BackendAuto to select AVX512 when available.
 	UseAVX512 bool
+
+	// Backend selects the implementation used for hashing.
+	// If the backend is not available, an *UnsupportedBackendError is returned.
+	// Default is BackendAuto, which selects AVX512 (if UseAVX512 is set), AVX2 or the stdlib,
+	// in that order.
+	Backend Backend
+
+	// ChunkSize is the maximum number of bytes sent to the server
+	// in a single block. It must be a multiple of BlockSize and at least 2*BlockSize.
+	// Default is 32KB.
+	ChunkSize int
+
+	// Lanes is the number of lanes processed per round. It must be 4, 8 or 16.
+	// Fewer lanes lower the latency of rounds, but hash fewer blocks at once.
+	// AVX2 processes up to 8 lanes on a single goroutine.
+	// Default is 16.
+	Lanes int
+
+	// BuffersPerLane is the number of ChunkSize buffers allocated per lane.
+	// It sets the default MemoryBudget.
+	// Default is 3.
+	BuffersPerLane int
+
+	// MemoryBudget is the maximum number of bytes used for buffers.
+	// Buffers are allocated when hashers need them, so an idle server uses none.
+	// It must fit at least one ChunkSize buffer.
+	// Default is BuffersPerLane*Lanes*ChunkSize.
+	MemoryBudget int
+
+	// IdleRelease frees the buffers once none of them has been in use for this long.
+	// They are allocated again when needed.
+	// Default is 0, which keeps the buffers until the server is closed.
+	IdleRelease time.Duration
+
+	// FlushThreshold is the number of bytes a hasher collects from writes
+	// smaller than this before sending them to the server.
+	// This avoids sending many small blocks, which fill lanes poorly.
+	// Collected writes are also sent on Sum.
+	// It must be a multiple of BlockSize and at most ChunkSize.
+	// Default is ChunkSize. A negative value disables collecting writes.
+	FlushThreshold int
+
+	// ScalarBelow will use the scalar routine for rounds with fewer lanes than this.
+	// Default is 3. A negative value disables the scalar routine.
+	ScalarBelow int
+
+	// MaxGatherDelay is the maximum time the server waits for more lanes
+	// to be filled before processing a round with fewer than MinLanes lanes.
+	// Waiting increases latency, but fills more lanes per round with bursty writers.
+	// Default is 0, which processes rounds as soon as no more input is queued.
+	MaxGatherDelay time.Duration
+
+	// MinLanes is the number of filled lanes to wait for when MaxGatherDelay is set.
+	// The server never waits for more lanes than there are registered hashers.
+	// Default is Lanes.
+	MinLanes int
+
+	// TrackHashers records the creation stack and activity of every hasher,
+	// to find hashers that are not closed. Open hashers are listed by
+	// TrackingServer.LiveHashers, and hashers that are garbage collected without
+	// being closed are reported to LeakHandler and closed.
+	// This slows down creating hashers, so it is meant for debugging.
+	TrackHashers bool
+
+	// LeakHandler is called with hashers that were garbage collected without being closed,
+	// if TrackHashers is set. It is called from a finalizer, so it must not block.
+	// Default is nil, which logs leaked hashers with the log package.
+	LeakHandler func(HasherInfo)
+}
+
+// withDefaults returns the options with defaults applied,
+// or an error if the options are invalid.
+func (o ServerOptions) withDefaults() (ServerOptions, error) {
+	if o.ChunkSize == 0 {
+		o.ChunkSize = internalBlockSize
+	}
+	if o.BuffersPerLane == 0 {
+		o.BuffersPerLane = buffersPerLane
+	}
+	if o.Lanes == 0 {
+		o.Lanes = Lanes
+	}
+	if o.MemoryBudget == 0 {
+		// Invalid sizes are reported below.
+		b := int64(o.BuffersPerLane) * int64(o.Lanes) * int64(o.ChunkSize)
+		if b > math.MaxInt32 {
+			b = math.MaxInt32
+		}
+		o.MemoryBudget = int(b)
+	}
+	if o.FlushThreshold == 0 {
+		o.FlushThreshold = o.ChunkSize
+	}
+	if o.ScalarBelow == 0 {
+		o.ScalarBelow = useScalarBelow
+	}
+	if o.MinLanes == 0 {
+		o.MinLanes = o.Lanes
+	}
+	switch {
+	case o.ChunkSize < 2*BlockSize || o.ChunkSize%BlockSize != 0:
+		return o, fmt.Errorf("md5simd: ChunkSize must be a multiple of %d and at least %d, got %d", BlockSize, 2*BlockSize, o.ChunkSize)
+	case o.Lanes != 4 && o.Lanes != 8 && o.Lanes != Lanes:
+		return o, fmt.Errorf("md5simd: Lanes must be 4, 8 or %d, got %d", Lanes, o.Lanes)
+	case o.BuffersPerLane < 0:
+		return o, fmt.Errorf("md5simd: BuffersPerLane must be positive, got %d", o.BuffersPerLane)
+	case o.MemoryBudget < o.ChunkSize:
+		return o, fmt.Errorf("md5simd: MemoryBudget must be at least ChunkSize (%d), got %d", o.ChunkSize, o.MemoryBudget)
+	case o.FlushThreshold > 0 && (o.FlushThreshold > o.ChunkSize || o.FlushThreshold%BlockSize != 0):
+		return o, fmt.Errorf("md5simd: FlushThreshold must be a multiple of %d and at most ChunkSize, got %d", BlockSize, o.FlushThreshold)
+	case o.IdleRelease < 0:
+		return o, fmt.Errorf("md5simd: IdleRelease cannot be negative, got %v", o.IdleRelease)
+	case o.ScalarBelow > o.Lanes:
+		return o, fmt.Errorf("md5simd: ScalarBelow cannot exceed %d, got %d", o.Lanes, o.ScalarBelow)
+	case o.MaxGatherDelay < 0:
+		return o, fmt.Errorf("md5simd: MaxGatherDelay cannot be negative, got %v", o.MaxGatherDelay)
+	case o.MinLanes < 0 || o.MinLanes > o.Lanes:
+		return o, fmt.Errorf("md5simd: MinLanes must be between 1 and %d, got %d", o.Lanes, o.MinLanes)
+	}
+	// The assembly addresses buffers with 32 bit offsets.
+	if int64(o.MemoryBudget) > math.MaxInt32-32 {
+		return o, fmt.Errorf("md5simd: buffers exceed %d bytes", math.MaxInt32)
+	}
+	return o, nil
 }
 
 type Hasher interface {
@@ -31,6 +317,114 @@ type Hasher interface {
 	Close()
 }
 
+// Cloner is implemented by hashers that can be forked.
+type Cloner interface {
+	// Clone returns an independent copy of the current state.
+	// The clone must be closed separately.
+	Clone() Hasher
+}
+
+// ErrHasher is implemented by hashers that report errors instead of panicking.
+type ErrHasher interface {
+	// ResetErr, SumErr and CloneErr are like Reset, Sum and Clone,
+	// but return an error when the hasher cannot be used.
+	// The error is ErrHasherClosed after Close, ErrServerClosed after the server
+	// was closed or wraps ErrInternal if the server failed to process the hash.
+	// Sum and Clone panic with these errors. Reset only panics with ErrHasherClosed,
+	// other errors are returned by the next operation.
+	// A hasher that failed with ErrInternal can be used again after ResetErr.
+	ResetErr() error
+	SumErr(in []byte) ([]byte, error)
+	CloneErr() (Hasher, error)
+}
+
+// TryWriter is implemented by hashers that can write without waiting.
+type TryWriter interface {
+	// TryWrite is like Write, but returns ErrWouldBlock instead of waiting
+	// for the server. n is the number of bytes written before that,
+	// so the rest of p can be retried or written later.
+	TryWrite(p []byte) (n int, err error)
+}
+
+// ContextHasher is implemented by hashers that can give up waiting for the server.
+type ContextHasher interface {
+	// WriteContext is like Write, but returns ctx.Err() when ctx is done
+	// before p was written. n is the number of bytes written before that.
+	WriteContext(ctx context.Context, p []byte) (n int, err error)
+
+	// SumContext is like Sum, but returns ctx.Err() when ctx is done before
+	// the sum is ready. The hash can still be used afterwards.
+	SumContext(ctx context.Context, in []byte) ([]byte, error)
+}
+
+// AsyncSummer is implemented by hashers that can sum without waiting.
+type AsyncSummer interface {
+	// SumAsync appends the current hash to in, like Sum, without waiting for it.
+	// The hash can be written to again before the sum is done.
+	SumAsync(in []byte) *SumFuture
+}
+
+// BuffersWriter is implemented by hashers that support vectored writes.
+type BuffersWriter interface {
+	// WriteBuffers writes all slices in bufs, as if they were a single Write.
+	// Use it for scatter/gather input with many small slices.
+	WriteBuffers(bufs net.Buffers) (n int64, err error)
+}
+
+// SumFuture is a sum started by AsyncSummer.SumAsync.
+type SumFuture struct {
+	in     []byte
+	digest [Size]byte
+	err    error
+	done   chan struct{}
+}
+
+// Wait waits for the sum and returns it appended to the slice passed to SumAsync.
+// nil is returned if the sum failed, see Err.
+func (f *SumFuture) Wait() []byte {
+	<-f.done
+	if f.err != nil {
+		return nil
+	}
+	return append(f.in, f.digest[:]...)
+}
+
+// Err waits for the sum and returns why it failed, or nil.
+func (f *SumFuture) Err() error {
+	<-f.done
+	return f.err
+}
+
+// Done reports whether the sum is done, so Wait will not block.
+func (f *SumFuture) Done() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Channel returns a channel that is closed when the sum is done.
+func (f *SumFuture) Channel() <-chan struct{} {
+	return f.done
+}
+
+var (
+	// ErrWouldBlock is returned by TryWrite when the server has no room for more input.
+	ErrWouldBlock = errors.New("md5simd: write would block")
+
+	// ErrHasherClosed is returned when a hasher is used after Close.
+	ErrHasherClosed = errors.New("md5simd: hasher closed")
+
+	// ErrServerClosed is returned when a hasher is used after its server was closed.
+	ErrServerClosed = errors.New("md5simd: server closed")
+
+	// ErrInternal is wrapped by the errors of hashers that failed
+	// because the server could not process them.
+	ErrInternal = errors.New("md5simd: internal error")
+)
+
 // StdlibHasher returns a Hasher that uses the stdlib for hashing.
 // Used hashers are stored in a pool for fast reuse.
 func StdlibHasher() Hasher {
@@ -55,9 +449,39 @@ func (s *fallbackServer) NewHash() Hasher {
 	return &md5Wrapper{Hash: md5Pool.New().(hash.Hash)}
 }
 
+// NewHashWithOptions returns a crypto/md5 hasher, since there is nothing to schedule.
+func (s *fallbackServer) NewHashWithOptions(opts HashOptions) Hasher {
+	return s.NewHash()
+}
+
 func (s *fallbackServer) Close() {
 }
 
+// LiveHashers returns nil, since crypto/md5 hashers are not tracked.
+func (s *fallbackServer) LiveHashers() []HasherInfo {
+	return nil
+}
+
+// Shutdown returns immediately, since the fallback server has no queue.
+func (s *fallbackServer) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Stats returns no statistics, since the fallback server does no scheduling.
+func (s *fallbackServer) Stats() Stats {
+	return Stats{}
+}
+
+// Saturated returns false, since crypto/md5 hashers never wait.
+func (s *fallbackServer) Saturated() bool {
+	return false
+}
+
+// NewHashErr returns a crypto/md5 hasher, which never fails.
+func (s *fallbackServer) NewHashErr(opts HashOptions) (Hasher, error) {
+	return s.NewHash(), nil
+}
+
 func (m *md5Wrapper) Close() {
 	if m.Hash != nil {
 		m.Reset()
@@ -65,3 +489,139 @@ func (m *md5Wrapper) Close() {
 		m.Hash = nil
 	}
 }
+
+// Clone returns an independent copy of the hash.
+func (m *md5Wrapper) Clone() Hasher {
+	c, err := m.CloneErr()
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// CloneErr returns an independent copy of the hash, or ErrHasherClosed.
+func (m *md5Wrapper) CloneErr() (Hasher, error) {
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	c := &md5Wrapper{Hash: md5Pool.New().(hash.Hash)}
+	if err := c.UnmarshalBinary(state); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Write writes p to the hash, or returns ErrHasherClosed.
+func (m *md5Wrapper) Write(p []byte) (int, error) {
+	if m.Hash == nil {
+		return 0, ErrHasherClosed
+	}
+	return m.Hash.Write(p)
+}
+
+// Reset resets the hash. It panics if the hasher is closed.
+func (m *md5Wrapper) Reset() {
+	if err := m.ResetErr(); err != nil {
+		panic(err)
+	}
+}
+
+// ResetErr resets the hash, or returns ErrHasherClosed.
+func (m *md5Wrapper) ResetErr() error {
+	if m.Hash == nil {
+		return ErrHasherClosed
+	}
+	m.Hash.Reset()
+	return nil
+}
+
+// Sum returns the sum. It panics if the hasher is closed.
+func (m *md5Wrapper) Sum(in []byte) []byte {
+	sum, err := m.SumErr(in)
+	if err != nil {
+		panic(err)
+	}
+	return sum
+}
+
+// SumErr returns the sum, or ErrHasherClosed.
+func (m *md5Wrapper) SumErr(in []byte) ([]byte, error) {
+	if m.Hash == nil {
+		return nil, ErrHasherClosed
+	}
+	return m.Hash.Sum(in), nil
+}
+
+// TryWrite writes p to the hash, which never blocks.
+func (m *md5Wrapper) TryWrite(p []byte) (int, error) {
+	return m.Write(p)
+}
+
+// WriteContext writes p to the hash, which never blocks.
+func (m *md5Wrapper) WriteContext(ctx context.Context, p []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return m.Write(p)
+}
+
+// SumContext returns the sum, which never blocks.
+func (m *md5Wrapper) SumContext(ctx context.Context, in []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.SumErr(in)
+}
+
+// SumAsync returns the sum, which is done immediately.
+func (m *md5Wrapper) SumAsync(in []byte) *SumFuture {
+	f := &SumFuture{in: in, done: make(chan struct{})}
+	_, f.err = m.SumErr(f.digest[:0])
+	close(f.done)
+	return f
+}
+
+// WriteBuffers writes all slices in bufs to the hash.
+func (m *md5Wrapper) WriteBuffers(bufs net.Buffers) (n int64, err error) {
+	for _, p := range bufs {
+		nn, err := m.Write(p)
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// MarshalBinary returns the state of the hash in the crypto/md5 format.
+func (m *md5Wrapper) MarshalBinary() ([]byte, error) {
+	if m.Hash == nil {
+		return nil, ErrHasherClosed
+	}
+	return m.Hash.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+// UnmarshalBinary restores a state produced by MarshalBinary.
+func (m *md5Wrapper) UnmarshalBinary(b []byte) error {
+	if m.Hash == nil {
+		return ErrHasherClosed
+	}
+	return m.Hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+}
+
+// checkBlocks validates the arguments to Blocks.
+func checkBlocks(states [][4]uint32, inputs [][]byte) error {
+	if len(states) != len(inputs) {
+		return errors.New("md5simd: number of states and inputs differ")
+	}
+	if len(inputs) > 16 {
+		return errors.New("md5simd: at most 16 lanes can be processed")
+	}
+	for _, in := range inputs {
+		if len(in)%BlockSize != 0 {
+			return errors.New("md5simd: input length must be a multiple of BlockSize")
+		}
+	}
+	return nil
+}
@@ -8,10 +8,17 @@ package md5simd
 
 import (
 	"bytes"
+	"crypto/md5"
+	"fmt"
 	"hash"
+	"io"
+	"math/rand"
+	"net/http/httptest"
 	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/klauspost/cpuid/v2"
 )
@@ -251,6 +258,249 @@ func BenchmarkAvx2Parallel(b *testing.B) {
 	hasAVX512 = restore
 }
 
+func BenchmarkManyHashers(b *testing.B) {
+	for _, size := range []int{16 << 10, 32 << 10, 64 << 10} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			benchmarkManyHashers(b, 64, size)
+		})
+	}
+}
+
+// benchmarkManyHashers hashes objects of blockSize bytes
+// with n concurrent hashers sharing a single server.
+func benchmarkManyHashers(b *testing.B, n, blockSize int) {
+	server := NewServer()
+	defer server.Close()
+	input := bytes.Repeat([]byte{0x61}, blockSize)
+	hashers := make([]Hasher, n)
+	for i := range hashers {
+		hashers[i] = server.NewHash()
+		defer hashers[i].Close()
+	}
+	b.SetBytes(int64(blockSize * n))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for j := 0; j < b.N; j++ {
+		var wg sync.WaitGroup
+		wg.Add(n)
+		for i := range hashers {
+			go func(h Hasher) {
+				defer wg.Done()
+				var tmp [Size]byte
+				h.Reset()
+				h.Write(input)
+				_ = h.Sum(tmp[:0])
+			}(hashers[i])
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkTinyWrites(b *testing.B) {
+	for _, size := range []int{1, 16, 100, 1000} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			benchmarkTinyWrites(b, ServerOptions{UseAVX512: true}, size)
+		})
+		b.Run(fmt.Sprintf("%dB-nocoalesce", size), func(b *testing.B) {
+			benchmarkTinyWrites(b, ServerOptions{UseAVX512: true, FlushThreshold: -1}, size)
+		})
+	}
+}
+
+// benchmarkTinyWrites hashes 256KB per hasher on 16 hashers,
+// using writes of writeSize bytes.
+func benchmarkTinyWrites(b *testing.B, opts ServerOptions, writeSize int) {
+	const size = 256 << 10
+	server, err := NewServerWithOptions(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Close()
+	input := bytes.Repeat([]byte{0x61}, size)
+	var h16 [16]Hasher
+	for i := range h16 {
+		h16[i] = server.NewHash()
+		defer h16[i].Close()
+	}
+	b.SetBytes(int64(size * len(h16)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for j := 0; j < b.N; j++ {
+		var wg sync.WaitGroup
+		wg.Add(len(h16))
+		for i := range h16 {
+			go func(h Hasher) {
+				defer wg.Done()
+				var tmp [Size]byte
+				h.Reset()
+				for p := input; len(p) > 0; {
+					n := writeSize
+					if n > len(p) {
+						n = len(p)
+					}
+					h.Write(p[:n])
+					p = p[n:]
+				}
+				_ = h.Sum(tmp[:0])
+			}(h16[i])
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkReadFrom(b *testing.B) {
+	server := NewServer()
+	defer server.Close()
+	h := server.NewHash()
+	defer h.Close()
+	input := bytes.Repeat([]byte{0x61}, 1<<20)
+	var tmp [Size]byte
+
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for j := 0; j < b.N; j++ {
+		h.Reset()
+		// Hide bytes.Reader's WriterTo, so io.Copy uses ReadFrom.
+		io.Copy(h, struct{ io.Reader }{bytes.NewReader(input)})
+		_ = h.Sum(tmp[:0])
+	}
+}
+
+func TestBatchAvx2(t *testing.T) {
+	if !hasAVX2 {
+		t.SkipNow()
+	}
+	// Make sure AVX512 is disabled
+	restore := hasAVX512
+	hasAVX512 = false
+	defer func() { hasAVX512 = restore }()
+
+	testSumBatch(t)
+	testBlocks(t)
+}
+
+func TestBlocksStaged(t *testing.T) {
+	if !hasAVX2 {
+		t.SkipNow()
+	}
+	rng := rand.New(rand.NewSource(0))
+	var msgs [16][]byte
+	for i := range msgs {
+		msgs[i] = make([]byte, BlockSize*rng.Intn(3*internalBlockSize/BlockSize))
+		rng.Read(msgs[i])
+	}
+	restore := hasAVX512
+	defer func() { hasAVX512 = restore }()
+	for _, avx512 := range []bool{false, restore} {
+		hasAVX512 = avx512
+		var want, got digest16
+		for i := range want.v0 {
+			want.v0[i], want.v1[i], want.v2[i], want.v3[i] = init0, init1, init2, init3
+		}
+		got = want
+		for i, msg := range msgs {
+			st := [4]uint32{init0, init1, init2, init3}
+			blockScalar(&st, msg)
+			want.v0[i], want.v1[i], want.v2[i], want.v3[i] = st[0], st[1], st[2], st[3]
+		}
+		blocksStaged(&got, msgs)
+		if got != want {
+			t.Errorf("AVX512 %v: got %v, want %v", avx512, got, want)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	if !hasAVX2 {
+		t.SkipNow()
+	}
+	server := NewServer()
+	defer server.Close()
+
+	const size = 100<<10 + 10
+	input := bytes.Repeat([]byte{0x61}, size)
+	want := md5.Sum(input)
+	var h16 [16]Hasher
+	for i := range h16 {
+		h16[i] = server.NewHash()
+	}
+	if got := server.(StatsServer).Stats().Clients; got != 16 {
+		t.Errorf("got %d clients, want 16", got)
+	}
+	var wg sync.WaitGroup
+	for i := range h16 {
+		wg.Add(1)
+		go func(h Hasher) {
+			defer wg.Done()
+			h.Write(input)
+			if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+				t.Errorf("got %x, want %x", got, want)
+			}
+		}(h16[i])
+	}
+	wg.Wait()
+	h16[0].Close()
+
+	st := server.(StatsServer).Stats()
+	if st.Clients != 15 {
+		t.Errorf("got %d clients, want 15", st.Clients)
+	}
+	rounds := st.RoundsAVX512 + st.RoundsAVX2Half + st.RoundsAVX2Full + st.RoundsScalarSingle + st.RoundsScalarMulti
+	var histRounds uint64
+	for _, n := range st.LanesFilled {
+		histRounds += n
+	}
+	if rounds == 0 || rounds != histRounds {
+		t.Errorf("got %d rounds, %d in histogram", rounds, histRounds)
+	}
+	// Sum trailers are hashed separately.
+	if min := uint64(16 * (size / BlockSize)); st.ActiveBlocks < min {
+		t.Errorf("got %d active blocks, want at least %d", st.ActiveBlocks, min)
+	}
+	t.Logf("%+v", st)
+
+	rec := httptest.NewRecorder()
+	StatsHandler(server.(StatsServer)).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE md5simd_rounds_total counter\n",
+		"md5simd_lanes_filled_bucket{le=\"+Inf\"} ",
+		"md5simd_clients 15\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestGatherDelay(t *testing.T) {
+	if !hasAVX2 {
+		t.SkipNow()
+	}
+	server, err := NewServerWithOptions(ServerOptions{UseAVX512: true, MaxGatherDelay: 5 * time.Millisecond, MinLanes: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// An idle hasher makes the server wait for lanes that never arrive.
+	idle := server.NewHash()
+	defer idle.Close()
+	h := server.NewHash()
+	defer h.Close()
+	input := bytes.Repeat([]byte{0x61}, 3*BlockSize)
+	h.Write(input)
+	want := md5.Sum(input)
+	if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+	st := server.(StatsServer).Stats()
+	if st.GatherTimeouts == 0 || st.GatherTime < 5*time.Millisecond {
+		t.Errorf("expected gather timeout, got %d timeouts in %v", st.GatherTimeouts, st.GatherTime)
+	}
+}
+
 // BenchmarkAvx2SingleWriter will benchmark the speed having only a single writer
 // writing blocks with the specified size.
 // This is pretty much the worst case scenario.
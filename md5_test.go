@@ -6,15 +6,24 @@ package md5simd
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"encoding"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"math"
 	"math/rand"
+	"net"
 	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 type md5Test struct {
@@ -244,7 +253,979 @@ func TestMd5Simulator(t *testing.T) {
 	})
 }
 
+func TestServerOptions(t *testing.T) {
+	for _, opts := range []ServerOptions{
+		{ChunkSize: 64},
+		{ChunkSize: 1000},
+		{ChunkSize: -128},
+		{BuffersPerLane: -1},
+		{ScalarBelow: Lanes + 1},
+		{ChunkSize: 1 << 30, BuffersPerLane: 1},
+		{MaxGatherDelay: -time.Second},
+		{MinLanes: Lanes + 1},
+		{MemoryBudget: 1000},
+		{MemoryBudget: -1},
+		{MemoryBudget: math.MaxInt32},
+		{IdleRelease: -time.Second},
+		{FlushThreshold: 100},
+		{FlushThreshold: 64 << 10},
+		{Lanes: 5},
+		{Lanes: 32},
+		{Lanes: 4, MinLanes: 8},
+		{Lanes: 4, ScalarBelow: 5},
+	} {
+		if _, err := NewServerWithOptions(opts); err == nil {
+			t.Errorf("%+v: expected error", opts)
+		}
+	}
+
+	for _, opts := range []ServerOptions{
+		{ChunkSize: 128, BuffersPerLane: 1},
+		{ChunkSize: 4 << 10, ScalarBelow: -1},
+		{ChunkSize: 256 << 10, BuffersPerLane: 2, ScalarBelow: Lanes, UseAVX512: true},
+		{MaxGatherDelay: time.Millisecond, MinLanes: 8, UseAVX512: true},
+		{MemoryBudget: 64 << 10, UseAVX512: true},
+		{FlushThreshold: -1, UseAVX512: true},
+		{FlushThreshold: 4 << 10, UseAVX512: true},
+		{MemoryBudget: 1 << 20, IdleRelease: time.Millisecond, UseAVX512: true},
+	} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			server, err := NewServerWithOptions(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			testMd5Simulator(t, 19, 5, 300<<10, server)
+		})
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	const chunk = 32 << 10
+	server, err := NewServerWithOptions(ServerOptions{
+		Backend:      BackendGeneric,
+		MemoryBudget: 4 * chunk,
+		IdleRelease:  10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	h := server.NewHash()
+	defer h.Close()
+	if got := server.(StatsServer).Stats().BufferBytes; got != 0 {
+		t.Fatalf("got %d buffer bytes before writing", got)
+	}
+	input := bytes.Repeat([]byte{0x61}, 100<<10)
+	want := md5.Sum(input)
+	for i := 0; i < 2; i++ {
+		h.Reset()
+		h.Write(input)
+		if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+			t.Fatalf("got %x, want %x", got, want)
+		}
+		if got := server.(StatsServer).Stats().BufferBytes; got == 0 || got > 4*chunk || got%chunk != 0 {
+			t.Errorf("got %d buffer bytes, want whole buffers up to %d", got, 4*chunk)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for server.(StatsServer).Stats().BufferReleases != uint64(i+1) {
+			if time.Now().After(deadline) {
+				t.Fatal("buffers were not released")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if got := server.(StatsServer).Stats().BufferBytes; got != 0 {
+			t.Errorf("got %d buffer bytes after release", got)
+		}
+	}
+
+	// Many hashers share a single buffer.
+	server2, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric, MemoryBudget: chunk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server2.Close()
+	testMd5Simulator(t, 19, 5, 300<<10, server2)
+}
+
+func TestMemoryGrowth(t *testing.T) {
+	opts, _, err := resolveOptions(ServerOptions{Backend: BackendGeneric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServerWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	h := server.NewHash()
+	defer h.Close()
+	h.Write(make([]byte, 100))
+	h.Sum(nil)
+	// A small hash needs a buffer for its blocks and one for the trailer, not the whole budget.
+	if got := server.(StatsServer).Stats().BufferBytes; got > 2*opts.ChunkSize {
+		t.Errorf("got %d buffer bytes for a 100 byte hash, want at most %d of %d", got, 2*opts.ChunkSize, opts.MemoryBudget)
+	}
+
+	// Nothing is sized by the budget before buffers are needed.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	big, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric, ChunkSize: 2 * BlockSize, MemoryBudget: 1 << 30})
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big.Close()
+	if got := after.TotalAlloc - before.TotalAlloc; got > 1<<20 {
+		t.Errorf("creating a server with a budget of 1GB allocated %d bytes", got)
+	}
+}
+
+func TestTryWrite(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric, ChunkSize: 4 << 10, MemoryBudget: 4 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	input := make([]byte, 100<<10)
+	rand.New(rand.NewSource(0)).Read(input)
+	want := md5.Sum(input)
+
+	// Hold the only buffer.
+	h := server.NewHash()
+	defer h.Close()
+	buf := server.(*md5Server).buffers.get()
+	if !server.(SaturatedServer).Saturated() {
+		t.Error("server with no free buffers is not saturated")
+	}
+	if n, err := h.(TryWriter).TryWrite(input[:10]); n != 10 || err != nil {
+		t.Fatalf("got %d, %v writing a partial block", n, err)
+	}
+	if n, err := h.(TryWriter).TryWrite(input[10:200]); n != 0 || err != ErrWouldBlock {
+		t.Fatalf("got %d, %v writing while saturated", n, err)
+	}
+	server.(*md5Server).buffers.put(buf)
+	if server.(SaturatedServer).Saturated() {
+		t.Error("idle server is saturated")
+	}
+
+	// Many hashers retry until all input is written.
+	var wg sync.WaitGroup
+	hashers := []Hasher{h, StdlibHasher()}
+	for i := 0; i < 8; i++ {
+		hashers = append(hashers, server.NewHash())
+	}
+	for i, h := range hashers {
+		wg.Add(1)
+		go func(i int, h Hasher) {
+			defer wg.Done()
+			p := input
+			if i == 0 {
+				p = p[10:]
+			}
+			var blocked int
+			for len(p) > 0 {
+				n, err := h.(TryWriter).TryWrite(p)
+				p = p[n:]
+				if err == ErrWouldBlock {
+					blocked++
+					runtime.Gosched()
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+				t.Errorf("hasher %d: got %x, want %x (blocked %d times)", i, got, want, blocked)
+			}
+		}(i, h)
+	}
+	wg.Wait()
+	for _, h := range hashers[1:] {
+		h.Close()
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := bytes.Repeat([]byte{0x61}, 1000)
+	want := md5.Sum(input)
+
+	for _, h := range []Hasher{server.NewHash(), StdlibHasher()} {
+		h.Close()
+		if _, err := h.Write(input); err != ErrHasherClosed {
+			t.Errorf("%T: got %v writing after close", h, err)
+		}
+		if _, err := h.(ErrHasher).SumErr(nil); err != ErrHasherClosed {
+			t.Errorf("%T: got %v summing after close", h, err)
+		}
+		if _, err := h.(ErrHasher).CloneErr(); err != ErrHasherClosed {
+			t.Errorf("%T: got %v cloning after close", h, err)
+		}
+		if err := h.(ErrHasher).ResetErr(); err != ErrHasherClosed {
+			t.Errorf("%T: got %v resetting after close", h, err)
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != ErrHasherClosed {
+					t.Errorf("%T: got panic %v resetting after close", h, r)
+				}
+			}()
+			h.Reset()
+		}()
+	}
+
+	// A failed hasher reports the error until it is reset.
+	h := server.NewHash()
+	h.Write(input)
+	h.(*md5Digest).cl.err.Store(clientError{err: fmt.Errorf("%w: test", ErrInternal)})
+	if _, err := h.Write(input); !errors.Is(err, ErrInternal) {
+		t.Errorf("got %v writing to a failed hasher", err)
+	}
+	if err := h.(AsyncSummer).SumAsync(nil).Err(); !errors.Is(err, ErrInternal) {
+		t.Errorf("got %v summing a failed hasher", err)
+	}
+	if err := h.(ErrHasher).ResetErr(); err != nil {
+		t.Fatal(err)
+	}
+	h.Write(input)
+	if got, err := h.(ErrHasher).SumErr(nil); err != nil || !bytes.Equal(got, want[:]) {
+		t.Errorf("got %x, %v after reset, want %x", got, err, want)
+	}
+
+	server.Close()
+	if _, err := server.(ErrServer).NewHashErr(HashOptions{}); err != ErrServerClosed {
+		t.Errorf("got %v creating a hasher after close", err)
+	}
+	for _, h := range []Hasher{h, server.NewHash()} {
+		if _, err := h.Write(input); err != ErrServerClosed {
+			t.Errorf("got %v writing after server close", err)
+		}
+		if _, err := h.(ErrHasher).SumErr(nil); err != ErrServerClosed {
+			t.Errorf("got %v summing after server close", err)
+		}
+		if f := h.(AsyncSummer).SumAsync(nil); f.Wait() != nil || f.Err() != ErrServerClosed {
+			t.Errorf("got %v summing async after server close", f.Err())
+		}
+		h.Close()
+	}
+}
+
+func TestServerPanic(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	srv := server.(*md5Server)
+
+	input := bytes.Repeat([]byte{0x61}, 100<<10)
+	want := md5.Sum(input)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := server.NewHash()
+			defer h.Close()
+			for j := 0; j < 10; j++ {
+				h.Reset()
+				h.Write(input)
+				if got, err := h.(ErrHasher).SumErr(nil); err != nil || !bytes.Equal(got, want[:]) {
+					t.Errorf("got %x, %v, want %x", got, err, want)
+				}
+			}
+		}()
+	}
+
+	// A client without a state slot makes processing its blocks panic.
+	for i := 0; i < 10; i++ {
+		bad := &client{slot: 1 << 30}
+		sumCh := make(chan sumResult, 1)
+		if i%2 == 0 {
+			// Fails in a lane, then drops the sum.
+			srv.ring.send(blockInput{cl: bad, msg: srv.buffers.get()[:BlockSize]})
+			srv.ring.send(blockInput{cl: bad, sumCh: sumCh})
+		} else {
+			// Fails when the trailer is given a lane.
+			srv.ring.send(blockInput{cl: bad, msg: srv.buffers.get()[:BlockSize], sumCh: sumCh})
+		}
+		if sum := <-sumCh; !errors.Is(sum.err, ErrInternal) {
+			t.Fatalf("got %v from a broken client", sum.err)
+		}
+	}
+	wg.Wait()
+	if server.(SaturatedServer).Saturated() {
+		t.Error("buffers of the failed lanes were not returned")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	input := bytes.Repeat([]byte{0x61}, 1<<20)
+	want := md5.Sum(input)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, ctx := range []context.Context{context.Background(), cancelled} {
+		server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := server.(*md5Server)
+
+		// Queue sums of many hashers, then shut down while they are processed.
+		var futures []*SumFuture
+		var hashers []Hasher
+		for i := 0; i < 20; i++ {
+			h := server.NewHash()
+			h.Write(input)
+			futures = append(futures, h.(AsyncSummer).SumAsync(nil))
+			hashers = append(hashers, h)
+		}
+		err = server.(ShutdownServer).Shutdown(ctx)
+		if err != nil && err != ctx.Err() {
+			t.Errorf("got %v, want nil or %v", err, ctx.Err())
+		}
+		select {
+		case <-srv.done:
+		default:
+			t.Error("shutdown returned before the server stopped")
+		}
+		var completed int
+		for i, f := range futures {
+			switch got := f.Wait(); {
+			case f.Err() == ErrServerClosed:
+			case f.Err() != nil:
+				t.Errorf("sum %d: got %v", i, f.Err())
+			case !bytes.Equal(got, want[:]):
+				t.Errorf("sum %d: got %x, want %x", i, got, want)
+			default:
+				completed++
+			}
+		}
+		if ctx.Err() == nil && completed != len(futures) {
+			t.Errorf("%d of %d sums completed", completed, len(futures))
+		}
+
+		if _, err := server.(ErrServer).NewHashErr(HashOptions{}); err != ErrServerClosed {
+			t.Errorf("got %v creating a hasher after shutdown", err)
+		}
+		for _, h := range hashers {
+			if _, err := h.(ErrHasher).SumErr(nil); err != ErrServerClosed {
+				t.Errorf("got %v summing after shutdown", err)
+			}
+			h.Close()
+		}
+		if st := server.(StatsServer).Stats(); st.BufferBytes != 0 {
+			t.Errorf("%d buffer bytes kept after shutdown", st.BufferBytes)
+		}
+		// Closing again returns immediately.
+		server.Close()
+	}
+}
+
+func TestShutdownRace(t *testing.T) {
+	// Hashers used while the server shuts down must fail, not hang.
+	input := make([]byte, 1000)
+	for i := 0; i < 20; i++ {
+		server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				h := server.NewHash()
+				defer h.Close()
+				for {
+					if _, err := h.Write(input); err != nil {
+						if err != ErrServerClosed {
+							t.Errorf("write: got %v, want %v", err, ErrServerClosed)
+						}
+						return
+					}
+					f := h.(AsyncSummer).SumAsync(nil)
+					select {
+					case <-f.Channel():
+					case <-time.After(10 * time.Second):
+						t.Error("sum did not complete")
+						return
+					}
+					if err := f.Err(); err != nil {
+						if err != ErrServerClosed {
+							t.Errorf("sum: got %v, want %v", err, ErrServerClosed)
+						}
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		server.Close()
+		wg.Wait()
+	}
+}
+
+func TestTrackHashers(t *testing.T) {
+	leaks := make(chan HasherInfo, 1)
+	server, err := NewServerWithOptions(ServerOptions{
+		Backend:      BackendGeneric,
+		TrackHashers: true,
+		LeakHandler:  func(info HasherInfo) { leaks <- info },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	h1 := server.NewHash()
+	h1.Write(make([]byte, 1000))
+	h1.Reset()
+	h1.Write(make([]byte, 1000))
+	h2 := server.NewHash()
+	live := server.(TrackingServer).LiveHashers()
+	if len(live) != 2 {
+		t.Fatalf("got %d live hashers, want 2", len(live))
+	}
+	if live[0].BytesWritten != 2000 || live[1].BytesWritten != 0 {
+		t.Errorf("got %d and %d bytes written, want 2000 and 0", live[0].BytesWritten, live[1].BytesWritten)
+	}
+	if !strings.Contains(live[0].Stack, "TestTrackHashers") {
+		t.Errorf("creator missing from stack:\n%s", live[0].Stack)
+	}
+	if live[0].LastActive.Before(live[0].Created) || live[0].Age < 0 {
+		t.Errorf("got creation %v, age %v, last active %v", live[0].Created, live[0].Age, live[0].LastActive)
+	}
+	h1.Close()
+	h2.Close()
+	if live := server.(TrackingServer).LiveHashers(); len(live) != 0 {
+		t.Fatalf("got %d live hashers after closing all", len(live))
+	}
+
+	// Forget a hasher, it must be reported and closed when it is collected.
+	func() {
+		h := server.NewHash()
+		h.Write(make([]byte, 100))
+	}()
+	timeout := time.After(10 * time.Second)
+	for leaked := false; !leaked; {
+		runtime.GC()
+		select {
+		case info := <-leaks:
+			if info.BytesWritten != 100 {
+				t.Errorf("got %d bytes written by the leaked hasher, want 100", info.BytesWritten)
+			}
+			leaked = true
+		case <-timeout:
+			t.Fatal("leaked hasher was not reported")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if live := server.(TrackingServer).LiveHashers(); len(live) != 0 {
+		t.Errorf("got %d live hashers after the leak was reported", len(live))
+	}
+	if st := server.(StatsServer).Stats(); st.Clients != 0 {
+		t.Errorf("got %d clients after the leak was reported", st.Clients)
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric, ChunkSize: 4 << 10, MemoryBudget: 4 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	input := make([]byte, 100<<10)
+	rand.New(rand.NewSource(0)).Read(input)
+	want := md5.Sum(input)
+
+	h := server.NewHash()
+	defer h.Close()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n, err := h.(ContextHasher).WriteContext(cancelled, input); n != 0 || err != context.Canceled {
+		t.Fatalf("got %d, %v writing with a cancelled context", n, err)
+	}
+
+	// Hold the only buffer, so writes and sums must give up.
+	buf := server.(*md5Server).buffers.get()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := h.(ContextHasher).WriteContext(ctx, input); err != context.DeadlineExceeded {
+		t.Fatalf("got %v writing while saturated", err)
+	}
+	if _, err := h.(ContextHasher).SumContext(ctx, nil); err != context.DeadlineExceeded {
+		t.Fatalf("got %v summing while saturated", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("cancellation took %v", d)
+	}
+	server.(*md5Server).buffers.put(buf)
+	if server.(SaturatedServer).Saturated() {
+		t.Error("buffers were not returned")
+	}
+
+	h.Reset()
+	if n, err := h.(ContextHasher).WriteContext(context.Background(), input); n != len(input) || err != nil {
+		t.Fatalf("got %d, %v writing", n, err)
+	}
+	got, err := h.(ContextHasher).SumContext(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want[:]) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+		t.Errorf("sum after SumContext: got %x, want %x", got, want)
+	}
+}
+
+func TestWriteBuffers(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	rng := rand.New(rand.NewSource(0))
+	for _, maxLen := range []int{1, 10, 100, 5000, 100 << 10} {
+		var bufs net.Buffers
+		var input []byte
+		for len(input) < 200<<10 {
+			b := make([]byte, rng.Intn(maxLen+1))
+			rng.Read(b)
+			bufs = append(bufs, b)
+			input = append(input, b...)
+		}
+		// Start with a partial block.
+		want := md5.Sum(append([]byte("prefix"), input...))
+
+		for _, h := range []Hasher{server.NewHash(), StdlibHasher()} {
+			before := server.(StatsServer).Stats()
+			h.Write([]byte("prefix"))
+			n, err := h.(BuffersWriter).WriteBuffers(append(net.Buffers{}, bufs...))
+			if err != nil || n != int64(len(input)) {
+				t.Fatalf("got %d, %v, want %d", n, err, len(input))
+			}
+			if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+				t.Errorf("%T max %d: got %x, want %x", h, maxLen, got, want)
+			}
+			h.Close()
+
+			// The blocks should be packed into full chunks, plus a round for the trailer.
+			var rounds uint64
+			for i, n := range server.(StatsServer).Stats().LanesFilled {
+				rounds += n - before.LanesFilled[i]
+			}
+			if max := uint64(len(input)/internalBlockSize + 2); rounds > max {
+				t.Errorf("%T max %d: got %d rounds, want at most %d", h, maxLen, rounds, max)
+			}
+		}
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric, FlushThreshold: 16 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	rng := rand.New(rand.NewSource(0))
+	input := make([]byte, 100<<10)
+	rng.Read(input)
+	want := md5.Sum(input)
+
+	h := server.NewHash()
+	defer h.Close()
+	// Each writer writes all of p in tiny pieces.
+	writers := []struct {
+		name  string
+		write func(p []byte) (int, error)
+	}{
+		{"Write", h.Write},
+		{"TryWrite", h.(TryWriter).TryWrite},
+		{"WriteContext", func(p []byte) (int, error) { return h.(ContextHasher).WriteContext(context.Background(), p) }},
+		{"WriteBuffers", func(p []byte) (int, error) {
+			n, err := h.(BuffersWriter).WriteBuffers(net.Buffers{p[:len(p)/2], p[len(p)/2:]})
+			return int(n), err
+		}},
+	}
+	for _, w := range writers {
+		for i := 0; i < 2; i++ {
+			before := server.(StatsServer).Stats()
+			for p := input; len(p) > 0; {
+				n := 100
+				if n > len(p) {
+					n = len(p)
+				}
+				n, _ = w.write(p[:n])
+				p = p[n:]
+			}
+			if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+				t.Fatalf("%s: got %x, want %x", w.name, got, want)
+			}
+			var rounds uint64
+			for i, n := range server.(StatsServer).Stats().LanesFilled {
+				rounds += n - before.LanesFilled[i]
+			}
+			// One round per flush, plus one for the trailer.
+			if max := uint64(len(input)/(16<<10) + 2); rounds > max {
+				t.Errorf("%s: got %d rounds, want at most %d", w.name, rounds, max)
+			}
+			h.Reset()
+		}
+	}
+
+	// Mix collected writes with the other ways of writing and reading state.
+	h.Write(input[:1000])
+	h.Write(input[1000:1100])
+	c := h.(Cloner).Clone()
+	defer c.Close()
+	h.(BuffersWriter).WriteBuffers(net.Buffers{input[1100:1200], input[1200:50000]})
+	h.Write(input[50000:50100])
+	for p := input[50100:60000]; len(p) > 0; {
+		n, _ := h.(TryWriter).TryWrite(p)
+		p = p[n:]
+	}
+	h.Write(input[60000:60100])
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write(input[60100:60200])
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		t.Fatal(err)
+	}
+	h.Write(input[60100:])
+	if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+		t.Errorf("mixed: got %x, want %x", got, want)
+	}
+	c.Write(input[1100:])
+	if got := c.Sum(nil); !bytes.Equal(got, want[:]) {
+		t.Errorf("clone: got %x, want %x", got, want)
+	}
+
+	// Idle hashers holding buffers must not block the others.
+	small, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric, MemoryBudget: 4 * internalBlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small.Close()
+	for i := 0; i < 8; i++ {
+		idle := small.NewHash()
+		defer idle.Close()
+		idle.Write(input[:100])
+	}
+	testMd5Simulator(t, 19, 5, 300<<10, small)
+}
+
+func TestReadFrom(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	input := make([]byte, 300<<10+17)
+	rand.New(rand.NewSource(0)).Read(input)
+	want := md5.Sum(input)
+	readers := map[string]func(io.Reader) io.Reader{
+		"plain":    func(r io.Reader) io.Reader { return r },
+		"half":     iotest.HalfReader,
+		"one-byte": iotest.OneByteReader,
+		"data-err": iotest.DataErrReader,
+	}
+	for name, wrap := range readers {
+		t.Run(name, func(t *testing.T) {
+			h := server.NewHash()
+			defer h.Close()
+			h.Write(input[:10])
+			// Hide bytes.Reader's WriterTo, so io.Copy uses ReadFrom.
+			n, err := io.Copy(h, wrap(struct{ io.Reader }{bytes.NewReader(input[10:])}))
+			if err != nil || n != int64(len(input)-10) {
+				t.Fatalf("got %d, %v", n, err)
+			}
+			if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+				t.Errorf("got %x, want %x", got, want)
+			}
+		})
+	}
+
+	// Read errors are returned, and the data read before is hashed.
+	h := server.NewHash()
+	defer h.Close()
+	n, err := h.(io.ReaderFrom).ReadFrom(iotest.TimeoutReader(bytes.NewReader(input)))
+	if err != iotest.ErrTimeout {
+		t.Fatalf("got error %v, want %v", err, iotest.ErrTimeout)
+	}
+	wantN := md5.Sum(input[:n])
+	if got := h.Sum(nil); !bytes.Equal(got, wantN[:]) {
+		t.Errorf("after error: got %x, want %x", got, wantN)
+	}
+
+	// Without buffers to hold, data is copied.
+	small, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric, MemoryBudget: internalBlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small.Close()
+	h2 := small.NewHash()
+	defer h2.Close()
+	if _, err := h2.(io.ReaderFrom).ReadFrom(bytes.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	if got := h2.Sum(nil); !bytes.Equal(got, want[:]) {
+		t.Errorf("copy: got %x, want %x", got, want)
+	}
+}
+
+// closingReader calls close once after the first read.
+type closingReader struct {
+	io.Reader
+	close func()
+}
+
+func (r *closingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if r.close != nil {
+		r.close()
+		r.close = nil
+	}
+	return n, err
+}
+
+func TestReadFromClosed(t *testing.T) {
+	input := make([]byte, 1<<20)
+	budgets := map[string]int{
+		"zero-copy": 0,
+		// Too small to hold a buffer while reading, so the data is copied.
+		"copy": 4 << 10,
+	}
+	for name, budget := range budgets {
+		t.Run(name, func(t *testing.T) {
+			server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric, ChunkSize: 4 << 10, MemoryBudget: budget})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			h := server.NewHash()
+			defer h.Close()
+			r := &closingReader{Reader: bytes.NewReader(input), close: server.Close}
+			n, err := h.(io.ReaderFrom).ReadFrom(r)
+			if !errors.Is(err, ErrServerClosed) {
+				t.Errorf("got %d, %v, want %v", n, err, ErrServerClosed)
+			}
+			if n == int64(len(input)) {
+				t.Errorf("all %d bytes were reported as written", n)
+			}
+		})
+	}
+}
+
+func TestWriteString(t *testing.T) {
+	// A single buffer, so it is taken before allocations are counted.
+	server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric, MemoryBudget: internalBlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	h := server.NewHash()
+	defer h.Close()
+	sw := h.(io.StringWriter)
+	s := strings.Repeat("md5simd", 10000)
+	allocs := testing.AllocsPerRun(10, func() {
+		h.Reset()
+		sw.WriteString(s)
+	})
+	// The debug checks record who takes buffers.
+	if allocs > 0 && !debugChecks {
+		t.Errorf("got %v allocations per WriteString", allocs)
+	}
+	want := md5.Sum([]byte(s))
+	if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestSumAsync(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	rng := rand.New(rand.NewSource(0))
+	input := make([]byte, 100<<10)
+	rng.Read(input)
+
+	hashers := []Hasher{StdlibHasher()}
+	for i := 0; i < 40; i++ {
+		hashers = append(hashers, server.NewHash())
+	}
+	sizes := make([]int, len(hashers))
+	futures := make([]*SumFuture, len(hashers))
+	for i, h := range hashers {
+		sizes[i] = rng.Intn(len(input) / 2)
+		h.Write(input[:sizes[i]])
+		futures[i] = h.(AsyncSummer).SumAsync([]byte("prefix"))
+		// The hash continues after the sum.
+		h.Write(input[sizes[i]:])
+	}
+	for i, f := range futures {
+		<-f.Channel()
+		if !f.Done() {
+			t.Errorf("hasher %d: sum is not done after channel was closed", i)
+		}
+		want := append([]byte("prefix"), md5Sum(input[:sizes[i]])...)
+		if got := f.Wait(); !bytes.Equal(got, want) {
+			t.Errorf("hasher %d: got %x, want %x", i, got, want)
+		}
+	}
+	want := md5.Sum(input)
+	for i, h := range hashers {
+		if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+			t.Errorf("hasher %d: got %x, want %x", i, got, want)
+		}
+		h.Close()
+	}
+}
+
+func md5Sum(b []byte) []byte {
+	sum := md5.Sum(b)
+	return sum[:]
+}
+
+func TestBackends(t *testing.T) {
+	for _, backend := range AvailableBackends() {
+		t.Run(backend.String(), func(t *testing.T) {
+			server, err := NewServerWithOptions(ServerOptions{Backend: backend})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			testMd5Simulator(t, 19, 5, 300<<10, server)
+		})
+	}
+
+	_, err := NewServerWithOptions(ServerOptions{Backend: 99})
+	var ube *UnsupportedBackendError
+	if !errors.As(err, &ube) || ube.Backend != 99 {
+		t.Errorf("expected UnsupportedBackendError, got %v", err)
+	}
+}
+
+func TestLaneWidth(t *testing.T) {
+	for _, backend := range AvailableBackends() {
+		if backend == BackendStdlib {
+			continue
+		}
+		for _, width := range []int{4, 8} {
+			t.Run(fmt.Sprintf("%v-%d", backend, width), func(t *testing.T) {
+				server, err := NewServerWithOptions(ServerOptions{Backend: backend, Lanes: width})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer server.Close()
+				testMd5Simulator(t, 19, 5, 300<<10, server)
+
+				st := server.(StatsServer).Stats()
+				for n, rounds := range st.LanesFilled[width+1:] {
+					if rounds != 0 {
+						t.Errorf("got %d rounds with %d lanes", rounds, width+1+n)
+					}
+				}
+				if st.RoundsAVX2Full != 0 {
+					t.Errorf("got %d full AVX2 rounds", st.RoundsAVX2Full)
+				}
+			})
+		}
+	}
+}
+
+func TestBackendRounds(t *testing.T) {
+	for _, backend := range AvailableBackends() {
+		if backend == BackendStdlib {
+			continue
+		}
+		server, err := NewServerWithOptions(ServerOptions{Backend: backend, ScalarBelow: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testMd5Simulator(t, 16, 2, 100<<10, server)
+		st := server.(StatsServer).Stats()
+		server.Close()
+
+		var got uint64
+		switch backend {
+		case BackendAVX512:
+			got = st.RoundsAVX512
+		case BackendAVX2:
+			got = st.RoundsAVX2Half + st.RoundsAVX2Full
+		case BackendScalarAsm:
+			got = st.RoundsScalarSingle + st.RoundsScalarMulti
+		case BackendGeneric:
+			got = st.RoundsGeneric
+		}
+		if got == 0 {
+			t.Errorf("%v: no rounds executed by the backend: %+v", backend, st)
+		}
+	}
+}
+
 // TestRandomInput tests a number of random inputs.
+func TestOptionalInterfaces(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewServerPool(2, ServerOptions{Backend: BackendGeneric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := map[string]Server{"server": server, "pool": pool, "fallback": &fallbackServer{}}
+	for name, s := range servers {
+		if _, ok := s.(interface {
+			OptionsServer
+			StatsServer
+			SaturatedServer
+			ErrServer
+			ShutdownServer
+			TrackingServer
+		}); !ok {
+			t.Errorf("%s: %T does not implement all server interfaces", name, s)
+		}
+		hashers := []Hasher{s.NewHash(), StdlibHasher()}
+		for _, h := range hashers {
+			if _, ok := h.(interface {
+				Cloner
+				ErrHasher
+				TryWriter
+				ContextHasher
+				AsyncSummer
+				BuffersWriter
+			}); !ok {
+				t.Errorf("%s: %T does not implement all hasher interfaces", name, h)
+			}
+			h.Close()
+		}
+		s.Close()
+	}
+}
+
 func TestRandomInput(t *testing.T) {
 	n := 500
 	if testing.Short() {
@@ -293,6 +1274,276 @@ func TestRandomInput(t *testing.T) {
 	}
 }
 
+func TestMarshalBinary(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	input := make([]byte, 100<<10)
+	rand.New(rand.NewSource(0)).Read(input)
+	want := md5.Sum(input)
+
+	for _, split := range []int{0, 1, 63, 64, 65, 1000, 32 << 10, 50<<10 + 17, len(input)} {
+		// SIMD -> stdlib
+		h := server.NewHash()
+		h.Write(input[:split])
+		state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Close()
+		h2 := md5.New()
+		if err := h2.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			t.Fatalf("split %d: %v", split, err)
+		}
+		h2.Write(input[split:])
+		if got := h2.Sum(nil); !bytes.Equal(got, want[:]) {
+			t.Errorf("split %d: simd->stdlib got %x, want %x", split, got, want)
+		}
+
+		// stdlib -> SIMD
+		h2 = md5.New()
+		h2.Write(input[:split])
+		state, err = h2.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range []Hasher{server.NewHash(), StdlibHasher()} {
+			// Dirty the state first to check it is replaced.
+			h.Write([]byte("dirty"))
+			if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+				t.Fatalf("split %d: %v", split, err)
+			}
+			h.Write(input[split:])
+			if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+				t.Errorf("split %d: stdlib->%T got %x, want %x", split, h, got, want)
+			}
+			h.Close()
+		}
+	}
+
+	h := server.NewHash()
+	defer h.Close()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary([]byte("md5\x02")); err == nil {
+		t.Error("expected error for invalid state")
+	}
+}
+
+func TestClone(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	rng := rand.New(rand.NewSource(0))
+	prefix := make([]byte, 200<<10+13)
+	rng.Read(prefix)
+	var suffixes [5][]byte
+	for i := range suffixes {
+		suffixes[i] = make([]byte, rng.Intn(100<<10))
+		rng.Read(suffixes[i])
+	}
+
+	for _, h := range []Hasher{server.NewHash(), StdlibHasher()} {
+		// Prefix is written in pieces, so blocks may still be queued when cloning.
+		for p := prefix; len(p) > 0; {
+			n := rng.Intn(len(p) + 1)
+			h.Write(p[:n])
+			p = p[n:]
+		}
+		clones := make([]Hasher, len(suffixes))
+		for i := range clones {
+			clones[i] = h.(Cloner).Clone()
+		}
+		h.Write([]byte("original"))
+
+		var wg sync.WaitGroup
+		for i := range clones {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer clones[i].Close()
+				clones[i].Write(suffixes[i])
+				want := md5.Sum(append(append([]byte{}, prefix...), suffixes[i]...))
+				if got := clones[i].Sum(nil); !bytes.Equal(got, want[:]) {
+					t.Errorf("%T clone %d: got %x, want %x", h, i, got, want)
+				}
+			}(i)
+		}
+		wg.Wait()
+		want := md5.Sum(append(append([]byte{}, prefix...), "original"...))
+		if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+			t.Errorf("%T original: got %x, want %x", h, got, want)
+		}
+		h.Close()
+	}
+}
+
+func TestStateSlotReuse(t *testing.T) {
+	// The stdlib fallback has no slot table, so always test a real server.
+	server, err := NewServerWithOptions(ServerOptions{Backend: BackendGeneric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	cycles := 1000000
+	if testing.Short() {
+		cycles = 20000
+	}
+	input := bytes.Repeat([]byte{0x61}, BlockSize)
+	want := md5.Sum(input)
+	probe := func() {
+		h := server.NewHash()
+		defer h.Close()
+		h.Write(input)
+		if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+			t.Fatalf("got %x, want %x", got, want)
+		}
+	}
+
+	var before, after runtime.MemStats
+	probe()
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for i := 0; i < cycles; i++ {
+		server.NewHash().Close()
+	}
+	// The probes are queued behind the close notifications.
+	probe()
+	probe()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	if st := server.(StatsServer).Stats(); st.StateSlots > 2 {
+		t.Errorf("got %d state slots after %d hashers were closed", st.StateSlots, cycles)
+	}
+	if after.HeapAlloc > before.HeapAlloc+1<<20 {
+		t.Errorf("heap grew from %d to %d bytes", before.HeapAlloc, after.HeapAlloc)
+	}
+}
+
+func testSumBatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	sizes := []int{0, 1, 55, 56, 63, 64, 65, 119, 120, 128, 1000, 32<<10 - 1, 32 << 10, 32<<10 + 100, 100<<10 + 7}
+	for n := 0; n <= 16; n++ {
+		msgs := make([][]byte, n)
+		for i := range msgs {
+			msgs[i] = make([]byte, sizes[rng.Intn(len(sizes))])
+			rng.Read(msgs[i])
+		}
+		got := SumBatch(msgs)
+		for i := range got {
+			var want [Size]byte
+			if i < n {
+				want = md5.Sum(msgs[i])
+			}
+			if got[i] != want {
+				t.Errorf("%d messages, lane %d (size %d): got %x, want %x", n, i, len(msgs[i]), got[i], want)
+			}
+		}
+	}
+	for _, size := range sizes {
+		msgs := make([][]byte, 16)
+		for i := range msgs {
+			msgs[i] = bytes.Repeat([]byte{byte(i)}, size)
+		}
+		got := SumBatch(msgs)
+		for i := range msgs {
+			if want := md5.Sum(msgs[i]); got[i] != want {
+				t.Errorf("size %d, lane %d: got %x, want %x", size, i, got[i], want)
+			}
+		}
+	}
+}
+
+func TestSumBatch(t *testing.T) {
+	testSumBatch(t)
+}
+
+func testBlocks(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	for _, lanes := range []int{0, 1, 2, 3, 8, 9, 16} {
+		msgs := make([][]byte, lanes)
+		states := make([][4]uint32, lanes)
+		for i := range msgs {
+			msgs[i] = make([]byte, BlockSize*rng.Intn(1500))
+			rng.Read(msgs[i])
+			states[i] = [4]uint32{init0, init1, init2, init3}
+		}
+		// Process in two calls to check chaining.
+		inputs := make([][]byte, lanes)
+		for i, msg := range msgs {
+			inputs[i] = msg[:BlockSize*rng.Intn(len(msg)/BlockSize+1)]
+		}
+		backend, err := Blocks(states, inputs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, msg := range msgs {
+			inputs[i] = msg[len(inputs[i]):]
+		}
+		if _, err := Blocks(states, inputs); err != nil {
+			t.Fatal(err)
+		}
+		// Add padding
+		for i, msg := range msgs {
+			trailer := make([]byte, BlockSize)
+			trailer[0] = 0x80
+			binary.LittleEndian.PutUint64(trailer[BlockSize-8:], uint64(len(msg))<<3)
+			inputs[i] = trailer
+		}
+		if _, err := Blocks(states, inputs); err != nil {
+			t.Fatal(err)
+		}
+		for i, msg := range msgs {
+			var got [Size]byte
+			for j, v := range states[i] {
+				binary.LittleEndian.PutUint32(got[4*j:], v)
+			}
+			if want := md5.Sum(msg); got != want {
+				t.Errorf("%d lanes (%v), lane %d: got %x, want %x", lanes, backend, i, got, want)
+			}
+		}
+	}
+
+	if _, err := Blocks(make([][4]uint32, 1), make([][]byte, 2)); err == nil {
+		t.Error("expected error for mismatched lanes")
+	}
+	if _, err := Blocks(make([][4]uint32, 17), make([][]byte, 17)); err == nil {
+		t.Error("expected error for too many lanes")
+	}
+	if _, err := Blocks(make([][4]uint32, 1), [][]byte{make([]byte, 65)}); err == nil {
+		t.Error("expected error for unaligned input")
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	testBlocks(t)
+}
+
+func benchmarkSumBatch(b *testing.B, size int) {
+	msgs := make([][]byte, 16)
+	for i := range msgs {
+		msgs[i] = bytes.Repeat([]byte{0x61 + byte(i)}, size)
+	}
+	b.SetBytes(int64(size * len(msgs)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for j := 0; j < b.N; j++ {
+		_ = SumBatch(msgs)
+	}
+}
+
+func BenchmarkSumBatch(b *testing.B) {
+	b.Run("1KB", func(b *testing.B) {
+		benchmarkSumBatch(b, 1024)
+	})
+	b.Run("4KB", func(b *testing.B) {
+		benchmarkSumBatch(b, 4*1024)
+	})
+	b.Run("32KB", func(b *testing.B) {
+		benchmarkSumBatch(b, 32*1024)
+	})
+}
+
 func benchmarkCryptoMd5(b *testing.B, blockSize int) {
 
 	input := bytes.Repeat([]byte{0x61}, blockSize)